@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+type BucketSettings struct {
+	Name         string `json:"name"`
+	DefaultTTLMs int    `json:"defaultTtlMs"`
+	MaxValueSize int    `json:"maxValueSize"`
+}
+
+type BucketName struct {
+	Name string `json:"name"`
+}
+
+type BucketListResponse struct {
+	Buckets []BucketSettings `json:"buckets"`
+}
+
+// getBucket loads a user's bucket inside a transaction, returning a *requestError if it doesn't exist.
+// The default bucket ("") always exists and has no defaults
+func getBucket(tx *gorm.DB, userID uint, name string) (*Bucket, error) {
+	if name == "" {
+		return &Bucket{}, nil
+	}
+	var bucket Bucket
+	err := tx.Where("user_id = ? AND name = ?", userID, name).First(&bucket).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, newNotFoundError(fmt.Sprintf("bucket %v does not exist", name))
+	}
+	return &bucket, err
+}
+
+func createBucket(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("createBucket", err, w)
+			return
+		}
+
+		var bs BucketSettings
+		err = json.NewDecoder(r.Body).Decode(&bs)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if bs.Name == "" {
+			APIUserError(w, "expected name to be non-empty")
+			return
+		}
+		if bs.DefaultTTLMs < 0 || bs.MaxValueSize < 0 {
+			APIUserError(w, "expected defaultTtlMs and maxValueSize not to be negative")
+			return
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			var count int64
+			if err = tx.Model(&Bucket{}).Where("user_id = ? AND name = ?", user.ID, bs.Name).Count(&count).Error; err != nil {
+				return err
+			} else if count > 0 {
+				return newConflictError(fmt.Sprintf("bucket %v already exists", bs.Name))
+			}
+			return tx.Create(&Bucket{UserID: int(user.ID), Name: bs.Name, DefaultTTLMs: bs.DefaultTTLMs, MaxValueSize: bs.MaxValueSize}).Error
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError("createBucket", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&bs)
+	}
+}
+
+func listBuckets(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("listBuckets", err, w)
+			return
+		}
+
+		var buckets []Bucket
+		if err = db.Where("user_id = ?", user.ID).Order("name").Find(&buckets).Error; err != nil {
+			APIServerError("listBuckets", err, w)
+			return
+		}
+
+		res := BucketListResponse{Buckets: []BucketSettings{}}
+		for _, bucket := range buckets {
+			res.Buckets = append(res.Buckets, BucketSettings{Name: bucket.Name, DefaultTTLMs: bucket.DefaultTTLMs, MaxValueSize: bucket.MaxValueSize})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// deleteBucket permanently removes a bucket along with all of its keys and their history
+func deleteBucket(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("deleteBucket", err, w)
+			return
+		}
+
+		var bn BucketName
+		err = json.NewDecoder(r.Body).Decode(&bn)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if bn.Name == "" {
+			APIUserError(w, "expected name to be non-empty")
+			return
+		}
+
+		var kvItems []KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			bucket, err := getBucket(tx, user.ID, bn.Name)
+			if err != nil {
+				return err
+			}
+			// Only live keys are reported to watchers, expired ones are already invisible
+			if err = liveKeys(tx, user.ID, bn.Name).Find(&kvItems).Error; err != nil {
+				return err
+			}
+			for i := range kvItems {
+				if err = keyEvent(tx, eventOpDelete, &kvItems[i], kvItems[i].Version); err != nil {
+					return err
+				}
+			}
+			if err = deleteBucketEventRules(tx, user.ID, bn.Name); err != nil {
+				return err
+			}
+			if err = deleteBucketKeySchemas(tx, user.ID, bn.Name); err != nil {
+				return err
+			}
+			// Trashed and expired keys are buried too, so keys in a bucket that's created again don't reuse versions
+			var removed []KVItem
+			if err = tx.Unscoped().Select("user_id", "bucket", "key", "version").Where("user_id = ? AND bucket = ?", user.ID, bn.Name).Find(&removed).Error; err != nil {
+				return err
+			} else if err = buryKeys(tx, removed); err != nil {
+				return err
+			}
+			ids := tx.Unscoped().Model(&KVItem{}).Select("id").Where("user_id = ? AND bucket = ?", user.ID, bn.Name)
+			if err = deleteKeyData(tx, ids); err != nil {
+				return err
+			}
+			if err = tx.Unscoped().Where("user_id = ? AND bucket = ?", user.ID, bn.Name).Delete(&KVItem{}).Error; err != nil {
+				return err
+			}
+			if err = tx.Unscoped().Where("user_id = ? AND bucket = ?", user.ID, bn.Name).Delete(&KVHistory{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(bucket).Error
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError("deleteBucket", err, w)
+			return
+		}
+		for i := range kvItems {
+			kvWatchers.publish(user.ID, deletedKeyChange(&kvItems[i]))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateBucket(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/bucket/create", ioutil.NopCloser(strings.NewReader(`{"name": "a", "defaultTtlMs": 20000, "maxValueSize": 4}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	createBucket(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	var buckets []Bucket
+	db.Find(&buckets)
+	if len(buckets) != 1 || buckets[0].Name != "a" || buckets[0].DefaultTTLMs != 20000 || buckets[0].MaxValueSize != 4 || buckets[0].UserID != int(user.ID) {
+		t.Errorf("expected bucket to be created correctly got %v", buckets)
+	}
+}
+
+func TestCreateBucketExists(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&Bucket{Name: "a", UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/bucket/create", ioutil.NopCloser(strings.NewReader(`{"name": "a"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	createBucket(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+}
+
+func TestCreateBucketBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/bucket/create", ioutil.NopCloser(strings.NewReader(`{"name": "a"}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	createBucket(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestListBuckets(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&Bucket{Name: "b", UserID: int(user.ID)})
+	db.Create(&Bucket{Name: "a", DefaultTTLMs: 100, UserID: int(user.ID)})
+	db.Create(&Bucket{Name: "c", UserID: int(user.ID) + 1})
+
+	req := httptest.NewRequest(http.MethodGet, "/bucket/list", nil)
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	listBuckets(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var bl BucketListResponse
+	if err := json.NewDecoder(res.Body).Decode(&bl); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if len(bl.Buckets) != 2 || bl.Buckets[0] != (BucketSettings{Name: "a", DefaultTTLMs: 100}) || bl.Buckets[1].Name != "b" {
+		t.Errorf("expected buckets a and b got %v", bl.Buckets)
+	}
+}
+
+func TestDeleteBucket(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&Bucket{Name: "a", UserID: int(user.ID)})
+	db.Create(&KVItem{Bucket: "a", Key: "some_key", Value: "1", TTL: -1, Version: 1, UserID: int(user.ID)})
+	db.Create(&KVHistory{Bucket: "a", Key: "some_key", Value: "1", TTL: -1, Version: 1, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "some_key", Value: "2", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/bucket/delete", ioutil.NopCloser(strings.NewReader(`{"name": "a"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	deleteBucket(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	// Check only the default bucket's key is left
+	var kvItems []KVItem
+	db.Unscoped().Find(&kvItems)
+	if len(kvItems) != 1 || kvItems[0].Bucket != "" || kvItems[0].Value != "2" {
+		t.Errorf("expected only the default bucket's key to be left got %v", kvItems)
+	}
+	var count int64
+	db.Unscoped().Model(&KVHistory{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected history to be removed got %v", count)
+	}
+	db.Unscoped().Model(&Bucket{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected bucket to be removed got %v", count)
+	}
+}
+
+func TestDeleteBucketMissing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/bucket/delete", ioutil.NopCloser(strings.NewReader(`{"name": "a"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	deleteBucket(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
+
+func TestSetKeyInBucket(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&Bucket{Name: "a", DefaultTTLMs: 20000, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "some_key", Value: "default bucket", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"bucket": "a", "key": "some_key", "value": "bucket a"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	// Check the same key name is separate in each bucket and the default TTL was applied
+	var kvItems []KVItem
+	db.Order("bucket").Find(&kvItems)
+	if len(kvItems) != 2 || kvItems[0].Value != "default bucket" || kvItems[1].Bucket != "a" || kvItems[1].Value != "bucket a" {
+		t.Fatalf("expected a key in each bucket got %v", kvItems)
+	}
+	if kvItems[1].TTL < int(time.Now().UnixMilli()+18000) || kvItems[1].TTL > int(time.Now().UnixMilli()+20000) {
+		t.Errorf("expected default ttl to be applied got %v", kvItems[1].TTL)
+	}
+
+	// Check reads are scoped to the bucket
+	req = httptest.NewRequest(http.MethodGet, "/kv/get", ioutil.NopCloser(strings.NewReader(`{"bucket": "a", "key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w = httptest.NewRecorder()
+	getKey(db)(w, req)
+
+	res = w.Result()
+	defer res.Body.Close()
+	var kv KeyValue
+	if err := json.NewDecoder(res.Body).Decode(&kv); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if kv.Bucket != "a" || kv.Value != "bucket a" {
+		t.Errorf("expected the bucket's value got %v %v", kv.Bucket, kv.Value)
+	}
+}
+
+func TestSetKeyBucketMaxValueSize(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&Bucket{Name: "a", MaxValueSize: 4, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"bucket": "a", "key": "some_key", "value": "12345"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 413 {
+		t.Errorf("expected 413 got %v", res.StatusCode)
+	}
+}
+
+func TestSetKeyMissingBucket(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"bucket": "a", "key": "some_key", "value": "1"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
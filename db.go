@@ -7,14 +7,134 @@ import (
 
 type User struct {
 	gorm.Model
-	Token string
+	Token            string
+	HistoryLimit     int `gorm:"default:10"`        // how many versions of each key to keep, 0 turns history off
+	TrashRetentionMs int `gorm:"default:604800000"` // how long deleted keys and queue messages are kept, 7 days
 }
 
 type KVItem struct {
 	gorm.Model
-	Key    string
-	Value  string
-	TTL    int // UnixMilli, -1 is do not expire
+	Bucket         string `gorm:"uniqueIndex:idx_kv_user_bucket_key,where:deleted_at IS NULL"` // "" is the default bucket
+	Key            string `gorm:"uniqueIndex:idx_kv_user_bucket_key"`
+	Type           string // "" is a plain string, other types keep their data in their own table
+	Value          string // may hold arbitrary bytes when set via /kv/raw/
+	ContentType    string
+	TTL            int // UnixMilli, -1 is do not expire
+	Version        int // starts at 1, or after the KVTombstone of a removed key, and goes up by one on every write
+	LastAccessedAt int // UnixMilli of the last read through /kv/get, /kv/raw/ or /kv/mget, 0 if never read
+	ReadCount      int // reads don't change the version
+	UserID         int `gorm:"uniqueIndex:idx_kv_user_bucket_key,priority:1"`
+	User           User
+	created        bool // set by typedKey when it creates the key, so touchKey reports it as new
+}
+
+// KVTombstone is the last version of a key that has been removed. Rows are never deleted
+// so that a key that's created again carries on from it and never reuses a version
+type KVTombstone struct {
+	gorm.Model
+	Bucket  string `gorm:"uniqueIndex:idx_kv_tombstone_key"`
+	Key     string `gorm:"uniqueIndex:idx_kv_tombstone_key"`
+	Version int
+	UserID  int `gorm:"uniqueIndex:idx_kv_tombstone_key,priority:1"`
+}
+
+// KVTag is one tag of a KVItem
+type KVTag struct {
+	gorm.Model
+	KVItemID uint   `gorm:"uniqueIndex:idx_kv_tag"`
+	Tag      string `gorm:"uniqueIndex:idx_kv_tag;index:idx_kv_tag_tag"`
+}
+
+// KVHistory is a snapshot of a KVItem, one is recorded for every version
+type KVHistory struct {
+	gorm.Model
+	Bucket      string `gorm:"index:idx_kv_history_user_key"`
+	Key         string `gorm:"index:idx_kv_history_user_key"`
+	Value       string
+	ContentType string
+	TTL         int
+	Version     int
+	UserID      int `gorm:"index:idx_kv_history_user_key"`
+}
+
+// KVHashField is one field of a KVItem with the hash type
+type KVHashField struct {
+	gorm.Model
+	KVItemID uint   `gorm:"uniqueIndex:idx_kv_hash_field"`
+	Field    string `gorm:"uniqueIndex:idx_kv_hash_field"`
+	Value    string
+}
+
+// KVZSetMember is one member of a KVItem with the sorted set type.
+// Members are ordered by score and then by member
+type KVZSetMember struct {
+	gorm.Model
+	KVItemID uint    `gorm:"uniqueIndex:idx_kv_zset_member;index:idx_kv_zset_score,priority:1"`
+	Member   string  `gorm:"uniqueIndex:idx_kv_zset_member"`
+	Score    float64 `gorm:"index:idx_kv_zset_score,priority:2"`
+}
+
+// KVListElement is one element of a KVItem with the list type.
+// Positions only matter for ordering, they go down when pushing
+// to the left of the list and up when pushing to the right
+type KVListElement struct {
+	gorm.Model
+	KVItemID uint `gorm:"uniqueIndex:idx_kv_list_position"`
+	Position int  `gorm:"uniqueIndex:idx_kv_list_position"`
+	Value    string
+}
+
+// Bucket is a named keyspace inside a user's KV store with its own defaults
+type Bucket struct {
+	gorm.Model
+	Name         string `gorm:"uniqueIndex:idx_bucket_user_name"`
+	DefaultTTLMs int    // applied to keys written without a TTL, 0 is do not expire
+	MaxValueSize int    // in bytes, 0 is no limit
+	UserID       int    `gorm:"uniqueIndex:idx_bucket_user_name"`
+	User         User
+}
+
+// Lock is a lease on a name. Rows are never deleted so that Token
+// keeps going up across every holder of the lock
+type Lock struct {
+	gorm.Model
+	Name      string `gorm:"uniqueIndex:idx_lock_user_name"`
+	Owner     string // "" when the lock has been released
+	ExpiresAt int    // UnixMilli, the lock is free after this
+	Token     int    // fencing token, goes up by one on every acquire
+	UserID    int    `gorm:"uniqueIndex:idx_lock_user_name"`
+	User      User
+}
+
+// RateLimit is the token bucket behind a /ratelimit/check key
+type RateLimit struct {
+	gorm.Model
+	Key        string `gorm:"uniqueIndex:idx_rate_limit_user_key"`
+	Tokens     float64
+	RefilledAt int // UnixMilli, when Tokens was last brought up to date
+	UserID     int `gorm:"uniqueIndex:idx_rate_limit_user_key"`
+	User       User
+}
+
+// EventRule sends a message to a queue namespace when a key in Bucket that starts with Prefix changes
+type EventRule struct {
+	gorm.Model
+	Bucket    string
+	Prefix    string
+	OnSet     bool
+	OnDelete  bool
+	OnExpire  bool
+	Namespace string
+	UserID    int
+	User      User
+}
+
+// KeySchema is a JSON Schema that the values of keys in Bucket that start with Prefix must match
+type KeySchema struct {
+	gorm.Model
+	Bucket string
+	Prefix string
+	Schema string
 	UserID int
 	User   User
 }
@@ -49,6 +169,64 @@ func getDB(options GetDBOptions) *gorm.DB {
 		panic("failed to connect database")
 	}
 
-	db.AutoMigrate(&User{}, &KVItem{}, &QueueItem{})
+	if err = migrate(db); err != nil {
+		panic("failed to migrate database")
+	}
 	return db
 }
+
+func migrate(db *gorm.DB) error {
+	if err := upgradeKVItems(db); err != nil {
+		return err
+	}
+	return db.AutoMigrate(&User{}, &Bucket{}, &KVItem{}, &KVHashField{}, &KVZSetMember{}, &KVListElement{}, &KVTag{}, &KVHistory{}, &KVTombstone{}, &Lock{}, &RateLimit{}, &EventRule{}, &KeySchema{}, &QueueItem{})
+}
+
+// upgradeKVItems brings a kv_items table from before keys had a unique index up to date and
+// deletes its duplicate keys. It has to run before AutoMigrate, which would fail to create the index
+func upgradeKVItems(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&KVItem{}) || db.Migrator().HasIndex(&KVItem{}, "idx_kv_user_bucket_key") {
+		return nil
+	}
+	// Deleting a duplicate key also deletes its data and tags
+	if err := db.AutoMigrate(&KVHashField{}, &KVZSetMember{}, &KVListElement{}, &KVTag{}); err != nil {
+		return err
+	}
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&KVItem{}); err != nil {
+		return err
+	}
+	for _, field := range stmt.Schema.Fields {
+		if field.DBName != "" && !db.Migrator().HasColumn(&KVItem{}, field.DBName) {
+			if err := db.Migrator().AddColumn(&KVItem{}, field.Name); err != nil {
+				return err
+			}
+		}
+	}
+	// Rows from before a column was added have NULL in it
+	for column, value := range map[string]interface{}{"bucket": "", "type": "", "content_type": "", "version": 1, "last_accessed_at": 0, "read_count": 0} {
+		if err := db.Exec("UPDATE kv_items SET "+column+" = ? WHERE "+column+" IS NULL", value).Error; err != nil {
+			return err
+		}
+	}
+	return dedupKVItems(db)
+}
+
+// dedupKVItems deletes duplicate keys that were created before keys had a unique index, keeping
+// the most recently updated one
+func dedupKVItems(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		err := tx.Raw(`SELECT id FROM kv_items AS older WHERE deleted_at IS NULL AND EXISTS (
+			SELECT 1 FROM kv_items AS newer WHERE newer.deleted_at IS NULL
+			AND newer.user_id = older.user_id AND newer.bucket = older.bucket AND newer.key = older.key
+			AND (newer.updated_at > older.updated_at OR (newer.updated_at = older.updated_at AND newer.id > older.id)))`).Scan(&ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		if err = deleteKeyData(tx, ids); err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&KVItem{}, ids).Error
+	})
+}
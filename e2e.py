@@ -36,6 +36,14 @@ try:
     assert kv_get.json()["value"] == key_value
     assert kv_get.json()["ttl"] == -1
 
+    # delete key
+    kv_delete = requests.post(
+        f"{addr}/kv/delete", headers=headers, json={"key": key_name}
+    )
+    assert kv_delete.status_code == 200
+    kv_get = requests.post(f"{addr}/kv/get", headers=headers, json={"key": key_name})
+    assert kv_get.status_code == 404
+
     # send queue item
     namespace = "a"
     message = "b"
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Operations on keys that event rules can send to a queue
+const (
+	eventOpSet    = "set" // any write that creates or changes a key
+	eventOpDelete = "delete"
+	eventOpExpire = "expire"
+)
+
+// KeyEvent is the message that's sent to a rule's queue namespace
+type KeyEvent struct {
+	Bucket     string `json:"bucket,omitempty"`
+	Key        string `json:"key"`
+	Op         string `json:"op"`
+	OldVersion int    `json:"oldVersion"` // 0 if the key didn't exist
+	NewVersion int    `json:"newVersion"` // 0 if the key was deleted or expired
+	At         int    `json:"at"`         // UnixMilli
+}
+
+func (rule *EventRule) matches(op string, key string) bool {
+	if !strings.HasPrefix(key, rule.Prefix) {
+		return false
+	}
+	switch op {
+	case eventOpSet:
+		return rule.OnSet
+	case eventOpDelete:
+		return rule.OnDelete
+	case eventOpExpire:
+		return rule.OnExpire
+	}
+	return false
+}
+
+// keyEvent sends a message to the queue of every rule that matches a change to a key.
+// It's called inside the same transaction as the change so a message is only sent if the change is committed
+func keyEvent(tx *gorm.DB, op string, kvItem *KVItem, oldVersion int) error {
+	var rules []EventRule
+	if err := tx.Where("user_id = ? AND bucket = ?", kvItem.UserID, kvItem.Bucket).Find(&rules).Error; err != nil {
+		return err
+	}
+
+	event := KeyEvent{Bucket: kvItem.Bucket, Key: kvItem.Key, Op: op, OldVersion: oldVersion, NewVersion: kvItem.Version, At: int(time.Now().UnixMilli())}
+	if op != eventOpSet {
+		event.NewVersion = 0
+	}
+	for _, rule := range rules {
+		if !rule.matches(op, kvItem.Key) {
+			continue
+		}
+		message, err := json.Marshal(&event)
+		if err != nil {
+			return err
+		}
+		if err = tx.Create(&QueueItem{UserID: kvItem.UserID, Namespace: rule.Namespace, Message: string(message), VisibleAt: 0}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type EventRuleRequest struct {
+	Bucket    string   `json:"bucket"`
+	Prefix    string   `json:"prefix"` // "" matches every key in the bucket
+	Ops       []string `json:"ops"`
+	Namespace string   `json:"namespace"`
+}
+
+type EventRuleResponse struct {
+	ID uint `json:"id"`
+	EventRuleRequest
+}
+
+type EventRuleListResponse struct {
+	Rules []EventRuleResponse `json:"rules"`
+}
+
+type EventRuleToDelete struct {
+	ID uint `json:"id"`
+}
+
+func newEventRuleResponse(rule *EventRule) EventRuleResponse {
+	res := EventRuleResponse{ID: rule.ID, EventRuleRequest: EventRuleRequest{Bucket: rule.Bucket, Prefix: rule.Prefix, Ops: []string{}, Namespace: rule.Namespace}}
+	for _, op := range []string{eventOpSet, eventOpDelete, eventOpExpire} {
+		if rule.matches(op, rule.Prefix) {
+			res.Ops = append(res.Ops, op)
+		}
+	}
+	return res
+}
+
+func createEventRule(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("createEventRule", err, w)
+			return
+		}
+
+		var er EventRuleRequest
+		err = json.NewDecoder(r.Body).Decode(&er)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if er.Namespace == "" {
+			APIUserError(w, "expected namespace to be non-empty")
+			return
+		}
+		if len(er.Ops) == 0 {
+			APIUserError(w, "expected at least one op")
+			return
+		}
+		rule := EventRule{UserID: int(user.ID), Bucket: er.Bucket, Prefix: er.Prefix, Namespace: er.Namespace}
+		for _, op := range er.Ops {
+			switch op {
+			case eventOpSet:
+				rule.OnSet = true
+			case eventOpDelete:
+				rule.OnDelete = true
+			case eventOpExpire:
+				rule.OnExpire = true
+			default:
+				APIUserError(w, fmt.Sprintf("expected ops to be %v, %v or %v", eventOpSet, eventOpDelete, eventOpExpire))
+				return
+			}
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if _, err := getBucket(tx, user.ID, er.Bucket); err != nil {
+				return err
+			}
+			return tx.Create(&rule).Error
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError("createEventRule", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		res := newEventRuleResponse(&rule)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+func listEventRules(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("listEventRules", err, w)
+			return
+		}
+
+		var rules []EventRule
+		if err = db.Where("user_id = ?", user.ID).Order("id").Find(&rules).Error; err != nil {
+			APIServerError("listEventRules", err, w)
+			return
+		}
+
+		res := EventRuleListResponse{Rules: []EventRuleResponse{}}
+		for i := range rules {
+			res.Rules = append(res.Rules, newEventRuleResponse(&rules[i]))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+func deleteEventRule(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("deleteEventRule", err, w)
+			return
+		}
+
+		var ed EventRuleToDelete
+		err = json.NewDecoder(r.Body).Decode(&ed)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if ed.ID == 0 {
+			APIUserError(w, "expected id to be non-empty")
+			return
+		}
+
+		result := db.Unscoped().Where("user_id = ? AND id = ?", user.ID, ed.ID).Delete(&EventRule{})
+		if result.Error != nil {
+			APIServerError("deleteEventRule", result.Error, w)
+			return
+		} else if result.RowsAffected == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// deleteBucketEventRules is for when a bucket is deleted
+func deleteBucketEventRules(tx *gorm.DB, userID uint, bucket string) error {
+	return tx.Unscoped().Where("user_id = ? AND bucket = ?", userID, bucket).Delete(&EventRule{}).Error
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreateEventRule(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/event/create", ioutil.NopCloser(strings.NewReader(`{"prefix": "session_", "ops": ["set", "expire"], "namespace": "some_namespace"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	createEventRule(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var er EventRuleResponse
+	if err := json.NewDecoder(res.Body).Decode(&er); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if er.ID != 1 || er.Prefix != "session_" || er.Namespace != "some_namespace" || len(er.Ops) != 2 || er.Ops[0] != "set" || er.Ops[1] != "expire" {
+		t.Errorf("expected rule to be created correctly got %v", er)
+	}
+
+	// Check the rule is listed
+	req = httptest.NewRequest(http.MethodGet, "/event/list", nil)
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w = httptest.NewRecorder()
+	listEventRules(db)(w, req)
+
+	res = w.Result()
+	defer res.Body.Close()
+	var el EventRuleListResponse
+	if err := json.NewDecoder(res.Body).Decode(&el); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if len(el.Rules) != 1 || el.Rules[0].ID != 1 || el.Rules[0].Prefix != "session_" {
+		t.Errorf("expected one rule got %v", el.Rules)
+	}
+}
+
+func TestCreateEventRuleBadRequest(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for _, body := range []string{
+		`{"ops": ["set"], "namespace": ""}`,
+		`{"ops": [], "namespace": "some_namespace"}`,
+		`{"ops": ["get"], "namespace": "some_namespace"}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/event/create", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		createEventRule(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("expected 400 for %v got %v", body, res.StatusCode)
+		}
+	}
+}
+
+func TestCreateEventRuleMissingBucket(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/event/create", ioutil.NopCloser(strings.NewReader(`{"bucket": "some_bucket", "ops": ["set"], "namespace": "some_namespace"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	createEventRule(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
+
+func TestCreateEventRuleBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/event/create", ioutil.NopCloser(strings.NewReader(`{"ops": ["set"], "namespace": "some_namespace"}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	createEventRule(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestDeleteEventRule(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&EventRule{OnSet: true, Namespace: "some_namespace", UserID: int(user.ID)})
+
+	// The second delete finds nothing
+	for _, expected := range []int{200, 404} {
+		req := httptest.NewRequest(http.MethodGet, "/event/delete", ioutil.NopCloser(strings.NewReader(`{"id": 1}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		deleteEventRule(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != expected {
+			t.Errorf("expected %v got %v", expected, res.StatusCode)
+		}
+	}
+}
+
+func TestKeyEvents(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&EventRule{Prefix: "session_", OnSet: true, OnDelete: true, OnExpire: true, Namespace: "some_namespace", UserID: int(user.ID)})
+	// An expired key that hasn't been cleared up yet
+	db.Create(&KVItem{Key: "session_b", Value: "some_value", TTL: 1, Version: 4, UserID: int(user.ID)})
+
+	for _, call := range []struct {
+		handler func(http.ResponseWriter, *http.Request)
+		body    string
+	}{
+		{setKey(db), `{"key": "session_a", "value": "some_value"}`},
+		{setKey(db), `{"key": "other_key", "value": "some_value"}`},
+		{setKey(db), `{"key": "session_a", "value": "some_value2"}`},
+		{deleteKey(db), `{"key": "session_a"}`},
+		{setKey(db), `{"key": "session_b", "value": "some_value"}`},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(call.body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		call.handler(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 for %v got %v", call.body, res.StatusCode)
+		}
+	}
+
+	// Check the events were sent in order and other keys were ignored
+	var queueItems []QueueItem
+	db.Where("namespace = ?", "some_namespace").Order("id").Find(&queueItems)
+	expected := []KeyEvent{
+		{Key: "session_a", Op: "set", OldVersion: 0, NewVersion: 1},
+		{Key: "session_a", Op: "set", OldVersion: 1, NewVersion: 2},
+		{Key: "session_a", Op: "delete", OldVersion: 2, NewVersion: 0},
+		{Key: "session_b", Op: "expire", OldVersion: 4, NewVersion: 0},
+		{Key: "session_b", Op: "set", OldVersion: 0, NewVersion: 5},
+	}
+	if len(queueItems) != len(expected) {
+		t.Fatalf("expected %v events got %v", len(expected), len(queueItems))
+	}
+	for i, queueItem := range queueItems {
+		var event KeyEvent
+		if err := json.Unmarshal([]byte(queueItem.Message), &event); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if event.Key != expected[i].Key || event.Op != expected[i].Op || event.OldVersion != expected[i].OldVersion || event.NewVersion != expected[i].NewVersion || event.At == 0 {
+			t.Errorf("expected %v got %v", expected[i], event)
+		}
+	}
+}
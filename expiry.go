@@ -0,0 +1,223 @@
+package main
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// expiryBatchSize bounds how many keys are deleted in one transaction
+const expiryBatchSize = 100
+
+// expiryRetryMs is how long to wait before trying a batch again after an error
+const expiryRetryMs = 1000
+
+// expiryIdle is how long the scheduler sleeps when it has nothing scheduled
+const expiryIdle = 1 * time.Hour
+
+type expiryEntry struct {
+	ttl int // UnixMilli
+	id  uint
+}
+
+// expiryHeap is a min-heap of keys ordered by when they expire. It has at most one entry per key,
+// index tracks where each key's entry is so its TTL can be changed in place
+type expiryHeap struct {
+	entries []expiryEntry
+	index   map[uint]int
+}
+
+func (h *expiryHeap) Len() int           { return len(h.entries) }
+func (h *expiryHeap) Less(i, j int) bool { return h.entries[i].ttl < h.entries[j].ttl }
+func (h *expiryHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.index[h.entries[i].id], h.index[h.entries[j].id] = i, j
+}
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(expiryEntry)
+	h.index[entry.id] = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+func (h *expiryHeap) Pop() interface{} {
+	entry := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	delete(h.index, entry.id)
+	return entry
+}
+
+// set adds a key's entry or moves its existing one earlier. Writes to the same key can be
+// scheduled out of order, so an entry is never moved later or removed here. Instead the key's
+// TTL is re-checked in the database when its entry comes up, and it's scheduled again if it
+// isn't due yet
+func (h *expiryHeap) set(id uint, ttl int) {
+	if ttl == -1 {
+		return
+	}
+	if i, ok := h.index[id]; !ok {
+		heap.Push(h, expiryEntry{ttl: ttl, id: id})
+	} else if ttl < h.entries[i].ttl {
+		h.entries[i].ttl = ttl
+		heap.Fix(h, i)
+	}
+}
+
+// expiryScheduler deletes keys shortly after their TTL passes. The heap only decides when to look
+// at a key, the key is re-checked in the database before it's deleted. So an entry for a key that
+// has since been deleted, persisted or given a later TTL is harmless. Keys must be scheduled
+// after they're committed
+type expiryScheduler struct {
+	mu      sync.Mutex
+	queue   expiryHeap
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newExpiryScheduler() *expiryScheduler {
+	return &expiryScheduler{queue: expiryHeap{index: map[uint]int{}}, wake: make(chan struct{}, 1), done: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+var kvExpiry = newExpiryScheduler()
+
+// schedule is called whenever a key's TTL may have been set
+func (s *expiryScheduler) schedule(kvItems ...*KVItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	earliest := false
+	for _, kvItem := range kvItems {
+		s.queue.set(kvItem.ID, kvItem.TTL)
+		earliest = earliest || (len(s.queue.entries) > 0 && s.queue.entries[0].id == kvItem.ID)
+	}
+	// The run loop only needs waking if it's now sleeping for too long
+	if earliest {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// due pops up to expiryBatchSize keys that have expired by now, otherwise
+// it returns how long until the next key expires
+func (s *expiryScheduler) due(now int) ([]uint, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []uint
+	for len(s.queue.entries) > 0 && s.queue.entries[0].ttl < now && len(ids) < expiryBatchSize {
+		ids = append(ids, heap.Pop(&s.queue).(expiryEntry).id)
+	}
+	if len(ids) > 0 || len(s.queue.entries) == 0 {
+		return ids, expiryIdle
+	}
+	// A key expires once now is past its TTL
+	return nil, time.Duration(s.queue.entries[0].ttl-now+1) * time.Millisecond
+}
+
+// start schedules every key with a TTL and begins deleting them as they expire
+func (s *expiryScheduler) start(db *gorm.DB) error {
+	var kvItems []KVItem
+	if err := db.Select("id", "ttl").Where("ttl != -1").Find(&kvItems).Error; err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for _, kvItem := range kvItems {
+		s.queue.index[kvItem.ID] = len(s.queue.entries)
+		s.queue.entries = append(s.queue.entries, expiryEntry{ttl: kvItem.TTL, id: kvItem.ID})
+	}
+	heap.Init(&s.queue)
+	s.mu.Unlock()
+
+	go s.run(db)
+	return nil
+}
+
+// stop waits for the batch that's being deleted, if there is one, to finish
+func (s *expiryScheduler) stop() {
+	close(s.done)
+	<-s.stopped
+}
+
+func (s *expiryScheduler) run(db *gorm.DB) {
+	defer close(s.stopped)
+	for {
+		ids, wait := s.due(int(time.Now().UnixMilli()))
+		if len(ids) > 0 {
+			pending, err := expireKeys(db, ids)
+			s.mu.Lock()
+			if err != nil {
+				log.Printf("expiryScheduler: error %v", err)
+				retry := int(time.Now().UnixMilli()) + expiryRetryMs
+				for _, id := range ids {
+					s.queue.set(id, retry)
+				}
+			}
+			for _, kvItem := range pending {
+				s.queue.set(kvItem.ID, kvItem.TTL)
+			}
+			s.mu.Unlock()
+			// Check for shutdown between batches
+			select {
+			case <-s.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-s.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// expireKeys deletes the keys in ids that have expired in one transaction. It returns the
+// keys that still have a TTL which hasn't passed, so they can be scheduled again
+func expireKeys(db *gorm.DB, ids []uint) ([]KVItem, error) {
+	var expired, pending []KVItem
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UnixMilli()
+		if err := tx.Select("id", "ttl").Where("id IN ? AND ttl != -1 AND ttl >= ?", ids, now).Find(&pending).Error; err != nil {
+			return err
+		} else if err := tx.Where("id IN ? AND ttl != -1 AND ttl < ?", ids, now).Find(&expired).Error; err != nil {
+			return err
+		} else if len(expired) == 0 {
+			return nil
+		}
+
+		expiredIDs := make([]uint, 0, len(expired))
+		for _, kvItem := range expired {
+			expiredIDs = append(expiredIDs, kvItem.ID)
+		}
+		// Expired keys go to the trash like deleted ones
+		if err := tx.Where("id IN ?", expiredIDs).Delete(&KVItem{}).Error; err != nil {
+			return err
+		}
+		if err := buryKeys(tx, expired); err != nil {
+			return err
+		}
+		for i := range expired {
+			if err := keyEvent(tx, eventOpExpire, &expired[i], expired[i].Version); err != nil {
+				return err
+			} else if err := deleteKeyHistory(tx, uint(expired[i].UserID), expired[i].Bucket, expired[i].Key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range expired {
+		kvWatchers.publish(uint(expired[i].UserID), deletedKeyChange(&expired[i]))
+	}
+	return pending, nil
+}
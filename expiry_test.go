@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestExpirySchedulerDue(t *testing.T) {
+	s := newExpiryScheduler()
+	later, persisted, sooner := &KVItem{TTL: 300}, &KVItem{TTL: -1}, &KVItem{TTL: 100}
+	later.ID, persisted.ID, sooner.ID = 1, 2, 3
+	s.schedule(later, persisted, sooner)
+
+	// Only keys whose TTL has passed are due, earliest first
+	ids, _ := s.due(200)
+	if len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("expected the key expiring at 100 to be due got %v", ids)
+	}
+	ids, wait := s.due(200)
+	if len(ids) != 0 || wait != 101*time.Millisecond {
+		t.Errorf("expected to wait 101ms got %v %v", ids, wait)
+	}
+
+	for i := 0; i < expiryBatchSize+1; i++ {
+		kvItem := &KVItem{TTL: 1}
+		kvItem.ID = uint(100 + i)
+		s.schedule(kvItem)
+	}
+	if ids, _ = s.due(200); len(ids) != expiryBatchSize {
+		t.Errorf("expected a batch of %v got %v", expiryBatchSize, len(ids))
+	}
+}
+
+func TestExpirySchedulerReschedule(t *testing.T) {
+	s := newExpiryScheduler()
+	kvItem, persisted := &KVItem{TTL: 500}, &KVItem{TTL: 100}
+	kvItem.ID, persisted.ID = 1, 2
+	s.schedule(kvItem, persisted)
+
+	// Writing a key again only ever moves its entry earlier, a later TTL or persisting it
+	// is picked up from the database when the entry comes up
+	for _, ttl := range []int{1000, 300, 400, -1} {
+		kvItem.TTL = ttl
+		s.schedule(kvItem)
+	}
+	persisted.TTL = -1
+	s.schedule(persisted)
+	if len(s.queue.entries) != 2 || s.queue.index[1] != 1 || s.queue.entries[1].ttl != 300 {
+		t.Errorf("expected one entry per key got %v", s.queue.entries)
+	}
+	if ids, _ := s.due(200); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("expected the persisted key to be due got %v", ids)
+	}
+	if ids, _ := s.due(301); len(ids) != 1 || ids[0] != 1 || len(s.queue.index) != 0 {
+		t.Errorf("expected the key to be due once got %v", ids)
+	}
+}
+
+func TestExpireKeys(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&EventRule{OnExpire: true, Namespace: "some_namespace", UserID: int(user.ID)})
+	expired := &KVItem{Key: "expired_key", Type: typeHash, TTL: 1, Version: 2, UserID: int(user.ID)}
+	db.Create(expired)
+	db.Create(&KVHashField{KVItemID: expired.ID, Field: "a", Value: "1"})
+	// A key whose TTL was extended after it was scheduled
+	live := &KVItem{Key: "live_key", Value: "some_value", TTL: int(time.Now().UnixMilli() + 20000), UserID: int(user.ID)}
+	db.Create(live)
+
+	pending, err := expireKeys(db, []uint{expired.ID, live.ID})
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if len(pending) != 1 || pending[0].ID != live.ID || pending[0].TTL != live.TTL {
+		t.Errorf("expected live_key to be scheduled again got %v", pending)
+	}
+
+	// Check only the expired key was deleted
+	var kvItems []KVItem
+	db.Find(&kvItems)
+	if len(kvItems) != 1 || kvItems[0].Key != "live_key" {
+		t.Errorf("expected only live_key to remain got %v", kvItems)
+	}
+	var fields int64
+	db.Model(&KVHashField{}).Count(&fields)
+	if fields != 1 {
+		t.Errorf("expected hash fields to be kept in the trash got %v", fields)
+	}
+	var queueItems []QueueItem
+	db.Find(&queueItems)
+	if len(queueItems) != 1 || !strings.Contains(queueItems[0].Message, `"op":"expire"`) {
+		t.Errorf("expected one expire event got %v", queueItems)
+	}
+}
+
+func TestExpirySchedulerRun(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "loaded_key", Value: "some_value", TTL: 1, UserID: int(user.ID)})
+	kvItem := &KVItem{Key: "some_key", Value: "some_value", TTL: -1, UserID: int(user.ID)}
+	db.Create(kvItem)
+
+	s := newExpiryScheduler()
+	if err := s.start(db); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	defer s.stop()
+
+	// A key that's scheduled after starting is deleted shortly after its TTL
+	kvItem.TTL = int(time.Now().UnixMilli() + 100)
+	db.Save(kvItem)
+	s.schedule(kvItem)
+
+	deadline := time.Now().Add(2 * time.Second)
+	var remaining int64
+	for time.Now().Before(deadline) {
+		db.Model(&KVItem{}).Count(&remaining)
+		if remaining == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if remaining != 0 {
+		t.Errorf("expected both keys to be deleted got %v remaining", remaining)
+	}
+}
+
+func TestExpirySchedulerRunOutOfOrder(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_key", Value: "some_value", TTL: -1, UserID: int(user.ID)}
+	db.Create(kvItem)
+
+	s := newExpiryScheduler()
+	if err := s.start(db); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	defer s.stop()
+
+	// The latest write is scheduled before two older ones, one that persisted the key
+	// and one with an earlier TTL that comes up before the key is due
+	ttl := int(time.Now().UnixMilli() + 300)
+	db.Model(kvItem).Update("ttl", ttl)
+	for _, stale := range []int{ttl, -1, ttl - 250} {
+		s.schedule(&KVItem{Model: gorm.Model{ID: kvItem.ID}, TTL: stale})
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	var remaining int64
+	for time.Now().Before(deadline) {
+		db.Model(&KVItem{}).Count(&remaining)
+		if remaining == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if remaining != 0 {
+		t.Errorf("expected the key to be deleted got %v remaining", remaining)
+	}
+	if time.Now().UnixMilli() <= int64(ttl) {
+		t.Errorf("expected the key to be deleted after its TTL")
+	}
+}
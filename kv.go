@@ -1,34 +1,185 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-// KVCron clears up expired keys every hour.
-// Note: these expired keys are already "invisible"
-func KVCron(db *gorm.DB) {
-	ticker := time.NewTicker(1 * time.Hour)
-	go func() {
-		for {
-			<-ticker.C
-			db.Delete(&KVItem{}, "TTL != -1 AND TTL < ?", time.Now().UnixMilli())
-		}
-	}()
+// userKey scopes a query to one of a user's keys, including
+// an expired key that hasn't been cleared up yet
+func userKey(tx *gorm.DB, userID uint, bucket string, key string) *gorm.DB {
+	return tx.Where("user_id = ? AND bucket = ? AND key = ?", userID, bucket, key)
+}
+
+// liveKeys scopes a query to the unexpired keys in one of a user's buckets
+func liveKeys(tx *gorm.DB, userID uint, bucket string) *gorm.DB {
+	return tx.Where("user_id = ? AND bucket = ? AND (ttl = -1 OR ttl >= ?)", userID, bucket, time.Now().UnixMilli())
+}
+
+func liveKey(tx *gorm.DB, userID uint, bucket string, key string) *gorm.DB {
+	return liveKeys(tx, userID, bucket).Where("key = ?", key)
 }
 
 type Key struct {
-	Key string `json:"key"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
 }
 
 type KeyValue struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-	TTL   int    `json:"ttl"`
+	Bucket      string `json:"bucket,omitempty"`
+	Key         string `json:"key"`
+	Type        string `json:"type,omitempty"` // set for keys that aren't plain strings, which have an empty value
+	Value       string `json:"value"`
+	Encoding    string `json:"encoding,omitempty"` // "base64" for values that aren't valid UTF-8
+	ContentType string `json:"contentType,omitempty"`
+	TTL         int    `json:"ttl"`
+	Version     int    `json:"version"`
+}
+
+// newKeyValue base64 encodes binary values so they survive being sent as JSON
+func newKeyValue(kvItem *KVItem) KeyValue {
+	kv := KeyValue{
+		Bucket:      kvItem.Bucket,
+		Key:         kvItem.Key,
+		Type:        kvItem.Type,
+		Value:       kvItem.Value,
+		ContentType: kvItem.ContentType,
+		TTL:         kvItem.TTL,
+		Version:     kvItem.Version,
+	}
+	if !utf8.ValidString(kv.Value) {
+		kv.Value = base64.StdEncoding.EncodeToString([]byte(kv.Value))
+		kv.Encoding = "base64"
+	}
+	return kv
+}
+
+type SetKeyRequest struct {
+	KeyValue
+	TTLMs     *int     `json:"ttlMs"`     // relative alternative to TTL
+	IfVersion *int     `json:"ifVersion"` // only write if the current version matches
+	IfAbsent  bool     `json:"ifAbsent"`  // only write if the key doesn't exist
+	Mode      string   `json:"mode"`      // "nx" or "xx", like ifAbsent but skipping the write isn't an error
+	Tags      []string `json:"tags"`      // replaces the key's tags, which are kept if this is missing
+	ttlSet    bool     // whether ttl was passed, as a ttl of -1 can't be told apart from the default
+}
+
+// Modes for SetKeyRequest, nx only creates a key that's missing (or expired)
+// and xx only updates a key that exists
+const (
+	setModeNX = "nx"
+	setModeXX = "xx"
+)
+
+// errNotWritten is returned by writeKey when a SetKeyRequest's mode doesn't hold
+var errNotWritten = errors.New("key was not written")
+
+// maxKeyWriteAttempts bounds how many times a write is retried when another write changes the key first
+const maxKeyWriteAttempts = 10
+
+// errKeyContended is returned when another write changed a key between reading and updating it,
+// and the write didn't have a condition that the change could break, so it can be retried
+var errKeyContended = errors.New("key was modified concurrently")
+
+// retryKeyWrites runs fc in a transaction, running it again while it fails with errKeyContended
+// so that unconditional writes are last-writer-wins. fc must not keep state between attempts
+func retryKeyWrites(db *gorm.DB, fc func(tx *gorm.DB) error) error {
+	var err error
+	for attempt := 1; attempt <= maxKeyWriteAttempts; attempt++ {
+		if err = db.Transaction(fc); !errors.Is(err, errKeyContended) {
+			return err
+		}
+	}
+	return newConflictError(err.Error())
+}
+
+// UnmarshalJSON defaults TTL to -1 so entries in batch requests
+// don't expire immediately when it's left out
+func (kv *SetKeyRequest) UnmarshalJSON(data []byte) error {
+	type setKeyRequest SetKeyRequest
+	req := setKeyRequest{KeyValue: KeyValue{TTL: -1}}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+	var ttl struct {
+		TTL *int `json:"ttl"`
+	}
+	if err := json.Unmarshal(data, &ttl); err != nil {
+		return err
+	}
+	*kv = SetKeyRequest(req)
+	kv.ttlSet = ttl.TTL != nil
+	return nil
+}
+
+// prepareSetKeyRequest turns a relative TTL into an absolute one and returns
+// a message describing what's wrong with kv, or "" if it's valid
+func prepareSetKeyRequest(kv *SetKeyRequest) string {
+	conditions := 0
+	for _, set := range []bool{kv.IfVersion != nil, kv.IfAbsent, kv.Mode != ""} {
+		if set {
+			conditions++
+		}
+	}
+	if kv.Key == "" {
+		return "key must not be empty or missing"
+	} else if conditions > 1 {
+		return "expected at most one of ifVersion, ifAbsent and mode"
+	} else if kv.Mode != "" && kv.Mode != setModeNX && kv.Mode != setModeXX {
+		return "expected mode to be nx, xx or missing"
+	} else if kv.Type != typeString {
+		return "expected type to be missing"
+	} else if msg := checkTags(kv.Tags); msg != "" {
+		return msg
+	}
+	if kv.Encoding == "base64" {
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return "expected value to be base64 encoded"
+		}
+		kv.Value, kv.Encoding = string(value), ""
+	} else if kv.Encoding != "" {
+		return "expected encoding to be base64 or missing"
+	}
+	if kv.TTLMs != nil {
+		ttl, msg := resolveTTL(kv.ttlSet, kv.TTLMs)
+		if msg != "" {
+			return msg
+		}
+		kv.TTL, kv.TTLMs = ttl, nil
+	}
+	return ""
+}
+
+type SetKeyResponse struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Version int    `json:"version"` // the current version if nothing was written, 0 for a missing key
+	Written bool   `json:"written"`
+}
+
+func newSetKeyResponse(kv *SetKeyRequest, kvItem *KVItem, written bool) SetKeyResponse {
+	res := SetKeyResponse{Bucket: kv.Bucket, Key: kv.Key, Written: written}
+	if kvItem != nil {
+		res.Version = kvItem.Version
+	}
+	return res
+}
+
+type KeyVersion struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Version int    `json:"version"`
 }
 
 func setKey(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
@@ -42,30 +193,225 @@ func setKey(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		kv := &KeyValue{TTL: -1}
+		kv := &SetKeyRequest{}
 		err = json.NewDecoder(r.Body).Decode(&kv)
 		if err != nil {
 			APIUserError(w, "error parsing JSON")
 			return
-		} else if kv.Key == "" {
-			APIUserError(w, "key must not be empty or missing")
+		} else if msg := prepareSetKeyRequest(kv); msg != "" {
+			APIUserError(w, msg)
 			return
 		}
 
-		// TODO: Use an upsert instead of a transaction plus two queries!
-		err = db.Transaction(func(tx *gorm.DB) error {
-			var ki KVItem
-			if err = tx.Where("user_id = ? AND key = ?", user.ID, kv.Key).First(&ki).Error; err != nil {
-				return tx.Create(&KVItem{UserID: int(user.ID), Key: kv.Key, Value: kv.Value, TTL: kv.TTL}).Error
-			}
-			return tx.Model(&ki).Updates(KVItem{Value: kv.Value, TTL: kv.TTL}).Error
+		var kvItem *KVItem
+		err = retryKeyWrites(db, func(tx *gorm.DB) error {
+			kvItem, err = writeKey(tx, user, kv)
+			return err
 		})
-		if err != nil {
+		written := true
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, errNotWritten) {
+			written = false
+		} else if err != nil {
 			APIServerError("setKey", err, w)
 			return
+		} else {
+			kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(kvItem)})
+			kvExpiry.schedule(kvItem)
 		}
+
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
+		res := newSetKeyResponse(kv, kvItem, written)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// writeKey creates or updates a key inside a transaction and returns the stored item.
+// A *requestError is returned if the bucket doesn't exist or the request's conditions don't hold,
+// errNotWritten along with the current item (if there is one) if the request's mode doesn't hold,
+// and errKeyContended if another write changed the key first and the request didn't have ifVersion
+func writeKey(tx *gorm.DB, user *User, kv *SetKeyRequest) (*KVItem, error) {
+	bucket, err := getBucket(tx, user.ID, kv.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if kv.TTL == -1 && bucket.DefaultTTLMs > 0 {
+		kv.TTL = int(time.Now().UnixMilli()) + bucket.DefaultTTLMs
+	}
+	if bucket.MaxValueSize > 0 && len(kv.Value) > bucket.MaxValueSize {
+		return nil, newTooLargeError(fmt.Sprintf("expected value to be at most %v bytes", bucket.MaxValueSize))
+	}
+	if err = checkKeySchemas(tx, user.ID, kv.Bucket, kv.Key, kv.Value); err != nil {
+		return nil, err
+	}
+
+	var ki KVItem
+	if err := userKey(tx, user.ID, kv.Bucket, kv.Key).First(&ki).Error; err != nil {
+		if kv.IfVersion != nil {
+			return nil, newConflictError("key does not exist")
+		} else if kv.Mode == setModeXX {
+			return nil, errNotWritten
+		}
+		last, err := lastKeyVersion(tx, user.ID, kv.Bucket, kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		ki = KVItem{UserID: int(user.ID), Bucket: kv.Bucket, Key: kv.Key, Value: kv.Value, ContentType: kv.ContentType, TTL: kv.TTL, Version: last + 1}
+		written, err := upsertKey(tx, &ki, !kv.IfAbsent && kv.Mode != setModeNX)
+		if err != nil {
+			return nil, err
+		} else if !written && kv.IfAbsent {
+			return nil, newConflictError("key already exists")
+		} else if !written {
+			return &ki, errNotWritten
+		}
+		// The key was created by a concurrent writer, possibly with another type
+		oldVersion := 0
+		if ki.Version > last+1 {
+			if err = deleteTypedData(tx, []uint{ki.ID}); err != nil {
+				return nil, err
+			}
+			oldVersion = ki.Version - 1
+		}
+		if err = keyEvent(tx, eventOpSet, &ki, oldVersion); err != nil {
+			return nil, err
+		} else if err = setKeyTags(tx, &ki, kv.Tags); err != nil {
+			return nil, err
+		}
+		return &ki, recordHistory(tx, user, &ki)
+	}
+
+	// An expired key that hasn't been cleared up yet counts as absent
+	expired := ki.TTL != -1 && ki.TTL < int(time.Now().UnixMilli())
+	if kv.IfAbsent && !expired {
+		return nil, newConflictError("key already exists")
+	} else if kv.IfVersion != nil && (expired || ki.Version != *kv.IfVersion) {
+		return nil, newConflictError("key version does not match")
+	} else if kv.Mode == setModeNX && !expired {
+		return &ki, errNotWritten
+	} else if kv.Mode == setModeXX && expired {
+		return nil, errNotWritten
+	}
+
+	oldVersion := ki.Version
+	if expired {
+		if err := keyEvent(tx, eventOpExpire, &ki, ki.Version); err != nil {
+			return nil, err
+		}
+		oldVersion = 0
+	}
+
+	// Like Redis, setting a key that holds another type replaces it with a string.
+	// An expired key is replaced entirely so it doesn't keep its tags either
+	if expired {
+		if err := deleteKeyData(tx, []uint{ki.ID}); err != nil {
+			return nil, err
+		}
+	} else if ki.Type != typeString {
+		if err := deleteTypedData(tx, []uint{ki.ID}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Matching on version means a concurrent writer can't be overwritten. Only ifVersion depends on
+	// the exact version, otherwise the write is retried and checked against the newer key
+	result := tx.Model(&KVItem{}).Where("id = ? AND version = ?", ki.ID, ki.Version).
+		Updates(map[string]interface{}{"type": typeString, "value": kv.Value, "content_type": kv.ContentType, "ttl": kv.TTL, "version": ki.Version + 1})
+	if result.Error != nil {
+		return nil, result.Error
+	} else if result.RowsAffected == 0 && kv.IfVersion != nil {
+		return nil, newConflictError("key version does not match")
+	} else if result.RowsAffected == 0 {
+		return nil, errKeyContended
 	}
+	ki.Type, ki.Value, ki.ContentType, ki.TTL, ki.Version = typeString, kv.Value, kv.ContentType, kv.TTL, ki.Version+1
+	if err := keyEvent(tx, eventOpSet, &ki, oldVersion); err != nil {
+		return nil, err
+	} else if err := setKeyTags(tx, &ki, kv.Tags); err != nil {
+		return nil, err
+	}
+	return &ki, recordHistory(tx, user, &ki)
+}
+
+// kvItemConflict targets the unique index on a user's live keys
+var kvItemConflict = clause.OnConflict{
+	Columns:     []clause.Column{{Name: "user_id"}, {Name: "bucket"}, {Name: "key"}},
+	TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "deleted_at IS NULL"}}},
+}
+
+// upsertKey creates ki in one query. If the key already exists, because a concurrent writer created
+// it after it was read, the key is overwritten, or left alone and false is returned if overwrite is false.
+// Either way ki is left holding the stored key
+func upsertKey(tx *gorm.DB, ki *KVItem, overwrite bool) (bool, error) {
+	onConflict := kvItemConflict
+	if overwrite {
+		onConflict.DoUpdates = clause.Assignments(map[string]interface{}{
+			"type": ki.Type, "value": ki.Value, "content_type": ki.ContentType, "ttl": ki.TTL,
+			"version": gorm.Expr("kv_items.version + 1"), "updated_at": time.Now(),
+		})
+	} else {
+		onConflict.DoNothing = true
+	}
+	result := tx.Clauses(onConflict, clause.Returning{}).Create(ki)
+	if result.Error != nil {
+		return false, result.Error
+	} else if result.RowsAffected == 0 {
+		return false, userKey(tx, uint(ki.UserID), ki.Bucket, ki.Key).First(ki).Error
+	}
+	return true, nil
+}
+
+// lastKeyVersion returns the highest version a removed key has had, or 0 if it's never been removed,
+// so that a key that's created again carries on from it
+func lastKeyVersion(tx *gorm.DB, userID uint, bucket string, key string) (int, error) {
+	var buried, trashed int
+	err := tx.Model(&KVTombstone{}).Select("COALESCE(MAX(version), 0)").
+		Where("user_id = ? AND bucket = ? AND key = ?", userID, bucket, key).Scan(&buried).Error
+	if err != nil {
+		return 0, err
+	}
+	// Keys trashed before there were tombstones only have their soft-deleted rows
+	err = tx.Unscoped().Model(&KVItem{}).Select("COALESCE(MAX(version), 0)").
+		Where("user_id = ? AND bucket = ? AND key = ? AND deleted_at IS NOT NULL", userID, bucket, key).Scan(&trashed).Error
+	if err != nil {
+		return 0, err
+	} else if trashed > buried {
+		return trashed, nil
+	}
+	return buried, nil
+}
+
+// buryKeys records the versions of keys that are being removed, see lastKeyVersion
+func buryKeys(tx *gorm.DB, kvItems []KVItem) error {
+	if len(kvItems) == 0 {
+		return nil
+	}
+	tombstones := make([]KVTombstone, 0, len(kvItems))
+	for _, kvItem := range kvItems {
+		tombstones = append(tombstones, KVTombstone{UserID: kvItem.UserID, Bucket: kvItem.Bucket, Key: kvItem.Key, Version: kvItem.Version})
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "bucket"}, {Name: "key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"version": gorm.Expr("MAX(kv_tombstones.version, excluded.version)"), "updated_at": time.Now(),
+		}),
+	}).CreateInBatches(&tombstones, maxBatchSize).Error
+}
+
+// GetKeyResponse only has metadata when the current version is read
+type GetKeyResponse struct {
+	KeyValue
+	*KeyMetadata
+}
+
+type GetKeyRequest struct {
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	Version *int   `json:"version"` // read an earlier version from the key's history
+	AsOf    *int   `json:"asOf"`    // UnixMilli, read the version that was current at this time
 }
 
 func getKey(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
@@ -79,7 +425,7 @@ func getKey(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		var k Key
+		var k GetKeyRequest
 		err = json.NewDecoder(r.Body).Decode(&k)
 		if err != nil {
 			APIUserError(w, "error parsing JSON")
@@ -89,9 +435,27 @@ func getKey(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
 			APIUserError(w, "expected key to be non-empty")
 			return
 		}
+		if k.Version != nil && k.AsOf != nil {
+			APIUserError(w, "expected at most one of version and asOf")
+			return
+		}
 
 		var kvItem KVItem
-		err = db.Where("user_id = ? AND key = ? AND (ttl = -1 OR ttl >= ?)", user.ID, k.Key, time.Now().UnixMilli()).First(&kvItem).Error
+		var meta *KeyMetadata
+		if k.Version != nil || k.AsOf != nil {
+			kvItem, err = getKeyAt(db, user.ID, &k)
+		} else {
+			err = db.Transaction(func(tx *gorm.DB) error {
+				if err := liveKey(tx, user.ID, k.Bucket, k.Key).First(&kvItem).Error; err != nil {
+					return err
+				} else if err := recordReads(tx, &kvItem); err != nil {
+					return err
+				}
+				tags, err := keyTags(tx, []uint{kvItem.ID})
+				meta = newKeyMetadata(&kvItem, tags[kvItem.ID])
+				return err
+			})
+		}
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -102,10 +466,503 @@ func getKey(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
 
 		w.WriteHeader(http.StatusOK)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(&KeyValue{
-			Key:   kvItem.Key,
-			Value: kvItem.Value,
-			TTL:   kvItem.TTL,
+		res := GetKeyResponse{KeyValue: newKeyValue(&kvItem), KeyMetadata: meta}
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+type DeleteKeyRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Trash  bool   `json:"trash"` // keep the key in the trash so it can be restored, otherwise it's removed for good
+}
+
+func deleteKey(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("deleteKey", err, w)
+			return
+		}
+
+		var dr DeleteKeyRequest
+		err = json.NewDecoder(r.Body).Decode(&dr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if dr.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+
+		var kvItem *KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			kvItem, err = removeKey(tx, user.ID, dr.Bucket, dr.Key, dr.Trash)
+			return err
+		})
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("deleteKey", err, w)
+			return
+		}
+		kvWatchers.publish(user.ID, deletedKeyChange(kvItem))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// removeKey deletes a key and its history inside a transaction and returns the deleted item,
+// or gorm.ErrRecordNotFound if it doesn't exist. With trash, the key is soft-deleted and
+// keeps its data in the trash until it's restored or purged
+func removeKey(tx *gorm.DB, userID uint, bucket string, key string, trash bool) (*KVItem, error) {
+	var kvItem KVItem
+	if err := liveKey(tx, userID, bucket, key).First(&kvItem).Error; err != nil {
+		return nil, err
+	}
+	if trash {
+		if err := tx.Delete(&kvItem).Error; err != nil {
+			return nil, err
+		}
+	} else if err := tx.Unscoped().Delete(&kvItem).Error; err != nil {
+		return nil, err
+	} else if err := deleteKeyData(tx, []uint{kvItem.ID}); err != nil {
+		return nil, err
+	}
+	if err := keyEvent(tx, eventOpDelete, &kvItem, kvItem.Version); err != nil {
+		return nil, err
+	} else if err := buryKeys(tx, []KVItem{kvItem}); err != nil {
+		return nil, err
+	}
+	return &kvItem, deleteKeyHistory(tx, userID, bucket, kvItem.Key)
+}
+
+type KeyListRequest struct {
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix"`
+	Cursor   string `json:"cursor"`
+	Limit    int    `json:"limit"`
+	Values   bool   `json:"values"`
+	Tag      string `json:"tag"`      // only list keys with this tag
+	Metadata bool   `json:"metadata"` // include the same metadata as /kv/get, without counting a read
+}
+
+type KeyListItem struct {
+	Key         string  `json:"key"`
+	Type        string  `json:"type,omitempty"`
+	Value       *string `json:"value,omitempty"`
+	Encoding    string  `json:"encoding,omitempty"`
+	ContentType string  `json:"contentType,omitempty"`
+	TTL         int     `json:"ttl"`
+	*KeyMetadata
+}
+
+type KeyListResponse struct {
+	Items  []KeyListItem `json:"items"`
+	Cursor string        `json:"cursor"` // empty when there are no more keys
+}
+
+const defaultListLimit = 100
+const maxListLimit = 1000
+
+// prefixEnd returns the smallest string that is greater than every string
+// starting with prefix, or "" if there isn't one (e.g. all 0xff bytes)
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+func listKeys(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("listKeys", err, w)
+			return
+		}
+
+		lr := &KeyListRequest{Limit: defaultListLimit}
+		err = json.NewDecoder(r.Body).Decode(&lr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if lr.Limit < 1 || lr.Limit > maxListLimit {
+			APIUserError(w, fmt.Sprintf("expected limit to be between 1 and %v", maxListLimit))
+			return
+		}
+		after, err := base64.RawURLEncoding.DecodeString(lr.Cursor)
+		if err != nil {
+			APIUserError(w, "invalid cursor")
+			return
+		}
+
+		query := liveKeys(db, user.ID, lr.Bucket)
+		if lr.Prefix != "" {
+			query = query.Where("key >= ?", lr.Prefix)
+			if end := prefixEnd(lr.Prefix); end != "" {
+				query = query.Where("key < ?", end)
+			}
+		}
+		if len(after) > 0 {
+			query = query.Where("key > ?", string(after))
+		}
+		if lr.Tag != "" {
+			query = query.Where("id IN (?)", taggedKeys(db, lr.Tag))
+		}
+
+		// Fetch one extra item to find out if there's another page
+		var kvItems []KVItem
+		err = query.Order("key").Limit(lr.Limit + 1).Find(&kvItems).Error
+		if err != nil {
+			APIServerError("listKeys", err, w)
+			return
+		}
+
+		res := KeyListResponse{Items: []KeyListItem{}}
+		if len(kvItems) > lr.Limit {
+			kvItems = kvItems[:lr.Limit]
+			res.Cursor = base64.RawURLEncoding.EncodeToString([]byte(kvItems[len(kvItems)-1].Key))
+		}
+		var tags map[uint][]string
+		if lr.Metadata && len(kvItems) > 0 {
+			ids := make([]uint, 0, len(kvItems))
+			for i := range kvItems {
+				ids = append(ids, kvItems[i].ID)
+			}
+			if tags, err = keyTags(db, ids); err != nil {
+				APIServerError("listKeys", err, w)
+				return
+			}
+		}
+		for i := range kvItems {
+			item := KeyListItem{Key: kvItems[i].Key, Type: kvItems[i].Type, TTL: kvItems[i].TTL}
+			if lr.Values {
+				kv := newKeyValue(&kvItems[i])
+				item.Value, item.Encoding, item.ContentType = &kv.Value, kv.Encoding, kv.ContentType
+			}
+			if lr.Metadata {
+				item.KeyMetadata = newKeyMetadata(&kvItems[i], tags[kvItems[i].ID])
+			}
+			res.Items = append(res.Items, item)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+const maxBatchSize = 1000
+
+type MultiGetRequest struct {
+	Bucket string   `json:"bucket"`
+	Keys   []string `json:"keys"`
+}
+
+type MultiGetResponse struct {
+	Found   []KeyValue `json:"found"`
+	Missing []string   `json:"missing"`
+}
+
+func multiGetKeys(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("multiGetKeys", err, w)
+			return
+		}
+
+		var mg MultiGetRequest
+		err = json.NewDecoder(r.Body).Decode(&mg)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if len(mg.Keys) == 0 || len(mg.Keys) > maxBatchSize {
+			APIUserError(w, fmt.Sprintf("expected between 1 and %v keys", maxBatchSize))
+			return
+		}
+		for _, key := range mg.Keys {
+			if key == "" {
+				APIUserError(w, "expected keys to be non-empty")
+				return
+			}
+		}
+
+		var kvItems []KVItem
+		err = liveKeys(db, user.ID, mg.Bucket).Where("key IN ?", mg.Keys).Find(&kvItems).Error
+		if err != nil {
+			APIServerError("multiGetKeys", err, w)
+			return
+		}
+		byKey := make(map[string]*KVItem, len(kvItems))
+		read := make([]*KVItem, 0, len(kvItems))
+		for i := range kvItems {
+			byKey[kvItems[i].Key] = &kvItems[i]
+			read = append(read, &kvItems[i])
+		}
+		if err = recordReads(db, read...); err != nil {
+			APIServerError("multiGetKeys", err, w)
+			return
+		}
+
+		// Results follow the order of the requested keys
+		res := MultiGetResponse{Found: []KeyValue{}, Missing: []string{}}
+		for _, key := range mg.Keys {
+			if kvItem, ok := byKey[key]; ok {
+				res.Found = append(res.Found, newKeyValue(kvItem))
+			} else {
+				res.Missing = append(res.Missing, key)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+type MultiSetRequest struct {
+	Items []SetKeyRequest `json:"items"`
+}
+
+type MultiSetResponse struct {
+	Items []SetKeyResponse `json:"items"`
+}
+
+// multiSetKeys writes every item in one transaction, if any item
+// fails its conditions then nothing is written. Items skipped
+// because of their mode don't stop the others from being written
+func multiSetKeys(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("multiSetKeys", err, w)
+			return
+		}
+
+		var ms MultiSetRequest
+		err = json.NewDecoder(r.Body).Decode(&ms)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if len(ms.Items) == 0 || len(ms.Items) > maxBatchSize {
+			APIUserError(w, fmt.Sprintf("expected between 1 and %v items", maxBatchSize))
+			return
+		}
+		for i := range ms.Items {
+			if msg := prepareSetKeyRequest(&ms.Items[i]); msg != "" {
+				APIUserError(w, fmt.Sprintf("item %v: %v", i, msg))
+				return
+			}
+		}
+
+		res := MultiSetResponse{Items: make([]SetKeyResponse, len(ms.Items))}
+		kvItems := make([]*KVItem, 0, len(ms.Items))
+		err = retryKeyWrites(db, func(tx *gorm.DB) error {
+			kvItems = kvItems[:0]
+			for i := range ms.Items {
+				kvItem, err := writeKey(tx, user, &ms.Items[i])
+				if rErr, ok := err.(*requestError); ok {
+					rErr.message = fmt.Sprintf("%v: %v", ms.Items[i].Key, rErr.message)
+					return rErr
+				} else if errors.Is(err, errNotWritten) {
+					res.Items[i] = newSetKeyResponse(&ms.Items[i], kvItem, false)
+					continue
+				} else if err != nil {
+					return err
+				}
+				kvItems = append(kvItems, kvItem)
+				res.Items[i] = newSetKeyResponse(&ms.Items[i], kvItem, true)
+			}
+			return nil
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError("multiSetKeys", err, w)
+			return
+		}
+		for _, kvItem := range kvItems {
+			kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(kvItem)})
+		}
+		kvExpiry.schedule(kvItems...)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+type IncrRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Delta  *int64 `json:"delta"` // defaults to 1
+	TTL    *int   `json:"ttl"`   // the existing TTL is kept if this is missing
+}
+
+type IncrResponse struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Value   int64  `json:"value"`
+	Version int    `json:"version"`
+}
+
+func incrOverflows(current int64, delta int64) bool {
+	return (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta)
+}
+
+// incrKey adds sign * delta to the integer stored at a key.
+// Missing (or expired) keys start at zero
+func incrKey(db *gorm.DB, sign int64) func(http.ResponseWriter, *http.Request) {
+	route := "incrKey"
+	if sign < 0 {
+		route = "decrKey"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError(route, err, w)
+			return
+		}
+
+		ir := &IncrRequest{}
+		err = json.NewDecoder(r.Body).Decode(&ir)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		} else if ir.Key == "" {
+			APIUserError(w, "key must not be empty or missing")
+			return
+		}
+		delta := int64(1)
+		if ir.Delta != nil {
+			delta = *ir.Delta
+		}
+		if sign < 0 {
+			if delta == math.MinInt64 {
+				APIUserError(w, "delta is out of range")
+				return
+			}
+			delta = -delta
+		}
+
+		res := IncrResponse{Bucket: ir.Bucket, Key: ir.Key}
+		var ki KVItem
+		err = retryKeyWrites(db, func(tx *gorm.DB) error {
+			ki = KVItem{}
+			bucket, err := getBucket(tx, user.ID, ir.Bucket)
+			if err != nil {
+				return err
+			}
+			if err = userKey(tx, user.ID, ir.Bucket, ir.Key).First(&ki).Error; err != nil {
+				ttl := -1
+				if ir.TTL != nil {
+					ttl = *ir.TTL
+				} else if bucket.DefaultTTLMs > 0 {
+					ttl = int(time.Now().UnixMilli()) + bucket.DefaultTTLMs
+				}
+				last, err := lastKeyVersion(tx, user.ID, ir.Bucket, ir.Key)
+				if err != nil {
+					return err
+				}
+				ki = KVItem{UserID: int(user.ID), Bucket: ir.Bucket, Key: ir.Key, Value: strconv.FormatInt(delta, 10), TTL: ttl, Version: last + 1}
+				if err = checkKeySchemas(tx, user.ID, ir.Bucket, ir.Key, ki.Value); err != nil {
+					return err
+				}
+				written, err := upsertKey(tx, &ki, false)
+				if err != nil {
+					return err
+				} else if written {
+					res.Value, res.Version = delta, ki.Version
+					if err = keyEvent(tx, eventOpSet, &ki, 0); err != nil {
+						return err
+					}
+					return recordHistory(tx, user, &ki)
+				}
+				// The key was created by a concurrent writer, ki now holds it so it's incremented below
+			}
+
+			// An expired key that hasn't been cleared up yet starts again like a missing one
+			current := int64(0)
+			ttl := ki.TTL
+			oldVersion := ki.Version
+			if expired := ki.TTL != -1 && ki.TTL < int(time.Now().UnixMilli()); expired {
+				if err = deleteKeyData(tx, []uint{ki.ID}); err != nil {
+					return err
+				} else if err = keyEvent(tx, eventOpExpire, &ki, ki.Version); err != nil {
+					return err
+				}
+				oldVersion = 0
+				ttl = -1
+				if bucket.DefaultTTLMs > 0 {
+					ttl = int(time.Now().UnixMilli()) + bucket.DefaultTTLMs
+				}
+			} else if ki.Type != typeString {
+				return wrongTypeError(&ki)
+			} else if current, err = strconv.ParseInt(ki.Value, 10, 64); err != nil {
+				return newConflictError("value is not an integer")
+			}
+			if ir.TTL != nil {
+				ttl = *ir.TTL
+			}
+			if incrOverflows(current, delta) {
+				return newConflictError("increment would overflow")
+			}
+
+			res.Value, res.Version = current+delta, ki.Version+1
+			if err = checkKeySchemas(tx, user.ID, ir.Bucket, ir.Key, strconv.FormatInt(res.Value, 10)); err != nil {
+				return err
+			}
+			result := tx.Model(&KVItem{}).Where("id = ? AND version = ?", ki.ID, ki.Version).
+				Updates(map[string]interface{}{"type": typeString, "value": strconv.FormatInt(res.Value, 10), "ttl": ttl, "version": res.Version})
+			if result.Error != nil {
+				return result.Error
+			} else if result.RowsAffected == 0 {
+				return errKeyContended
+			}
+			ki.Type, ki.Value, ki.TTL, ki.Version = typeString, strconv.FormatInt(res.Value, 10), ttl, res.Version
+			if err = keyEvent(tx, eventOpSet, &ki, oldVersion); err != nil {
+				return err
+			}
+			return recordHistory(tx, user, &ki)
 		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError(route, err, w)
+			return
+		}
+		kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(&ki)})
+		kvExpiry.schedule(&ki)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
 	}
 }
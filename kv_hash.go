@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+type HashSetRequest struct {
+	Bucket string            `json:"bucket"`
+	Key    string            `json:"key"`
+	Fields map[string]string `json:"fields"`
+}
+
+type HashSetResponse struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Added   int    `json:"added"` // how many of the fields didn't exist before
+	Version int    `json:"version"`
+}
+
+type HashFieldRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Field  string `json:"field"`
+}
+
+type HashField struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Field   string `json:"field"`
+	Value   string `json:"value"`
+	Version int    `json:"version"`
+}
+
+type HashResponse struct {
+	Bucket  string            `json:"bucket,omitempty"`
+	Key     string            `json:"key"`
+	Fields  map[string]string `json:"fields"`
+	TTL     int               `json:"ttl"`
+	Version int               `json:"version"`
+}
+
+type HashDeleteRequest struct {
+	Bucket string   `json:"bucket"`
+	Key    string   `json:"key"`
+	Fields []string `json:"fields"`
+}
+
+type HashDeleteResponse struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Removed int    `json:"removed"`
+	Version int    `json:"version"`
+	Deleted bool   `json:"deleted"` // the last field was removed so the key was deleted too
+}
+
+type HashIncrRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Field  string `json:"field"`
+	Delta  *int64 `json:"delta"` // defaults to 1
+}
+
+type HashIncrResponse struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Field   string `json:"field"`
+	Value   int64  `json:"value"`
+	Version int    `json:"version"`
+}
+
+// hashSet creates or updates fields of a hash without touching its other fields.
+// A missing key is created with the bucket's default TTL
+func hashSet(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("hashSet", err, w)
+			return
+		}
+
+		var hs HashSetRequest
+		err = json.NewDecoder(r.Body).Decode(&hs)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if hs.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+		if len(hs.Fields) == 0 || len(hs.Fields) > maxBatchSize {
+			APIUserError(w, fmt.Sprintf("expected between 1 and %v fields", maxBatchSize))
+			return
+		}
+		if _, ok := hs.Fields[""]; ok {
+			APIUserError(w, "expected fields to be non-empty")
+			return
+		}
+
+		res := HashSetResponse{Bucket: hs.Bucket, Key: hs.Key}
+		var kvItem *KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			bucket, err := getBucket(tx, user.ID, hs.Bucket)
+			if err != nil {
+				return err
+			}
+			for field, value := range hs.Fields {
+				if bucket.MaxValueSize > 0 && len(value) > bucket.MaxValueSize {
+					return newTooLargeError(fmt.Sprintf("expected field %v to be at most %v bytes", field, bucket.MaxValueSize))
+				}
+			}
+
+			if kvItem, err = typedKey(tx, user, hs.Bucket, hs.Key, typeHash, true); err != nil {
+				return err
+			}
+			for field, value := range hs.Fields {
+				var hf KVHashField
+				err = tx.Where("kv_item_id = ? AND field = ?", kvItem.ID, field).First(&hf).Error
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					if err = tx.Create(&KVHashField{KVItemID: kvItem.ID, Field: field, Value: value}).Error; err != nil {
+						return err
+					}
+					res.Added++
+				} else if err != nil {
+					return err
+				} else if err = tx.Model(&hf).Update("value", value).Error; err != nil {
+					return err
+				}
+			}
+			return touchKey(tx, kvItem)
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError("hashSet", err, w)
+			return
+		}
+		kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(kvItem)})
+		kvExpiry.schedule(kvItem)
+		res.Version = kvItem.Version
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+func hashGet(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("hashGet", err, w)
+			return
+		}
+
+		var hf HashFieldRequest
+		err = json.NewDecoder(r.Body).Decode(&hf)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if hf.Key == "" || hf.Field == "" {
+			APIUserError(w, "expected key and field to be non-empty")
+			return
+		}
+
+		var field KVHashField
+		kvItem, err := liveTypedKey(db, user.ID, hf.Bucket, hf.Key, typeHash)
+		if err == nil {
+			err = db.Where("kv_item_id = ? AND field = ?", kvItem.ID, hf.Field).First(&field).Error
+		}
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("hashGet", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&HashField{Bucket: kvItem.Bucket, Key: kvItem.Key, Field: field.Field, Value: field.Value, Version: kvItem.Version})
+	}
+}
+
+func hashGetAll(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("hashGetAll", err, w)
+			return
+		}
+
+		var k Key
+		err = json.NewDecoder(r.Body).Decode(&k)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if k.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+
+		var fields []KVHashField
+		kvItem, err := liveTypedKey(db, user.ID, k.Bucket, k.Key, typeHash)
+		if err == nil {
+			err = db.Where("kv_item_id = ?", kvItem.ID).Find(&fields).Error
+		}
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("hashGetAll", err, w)
+			return
+		}
+
+		res := HashResponse{Bucket: kvItem.Bucket, Key: kvItem.Key, Fields: make(map[string]string, len(fields)), TTL: kvItem.TTL, Version: kvItem.Version}
+		for _, field := range fields {
+			res.Fields[field.Field] = field.Value
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// hashDelete removes fields from a hash, the key is deleted along with its last field
+func hashDelete(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("hashDelete", err, w)
+			return
+		}
+
+		var hd HashDeleteRequest
+		err = json.NewDecoder(r.Body).Decode(&hd)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if hd.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+		if len(hd.Fields) == 0 || len(hd.Fields) > maxBatchSize {
+			APIUserError(w, fmt.Sprintf("expected between 1 and %v fields", maxBatchSize))
+			return
+		}
+
+		res := HashDeleteResponse{Bucket: hd.Bucket, Key: hd.Key}
+		var kvItem *KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if kvItem, err = typedKey(tx, user, hd.Bucket, hd.Key, typeHash, false); err != nil {
+				return err
+			}
+			result := tx.Unscoped().Where("kv_item_id = ? AND field IN ?", kvItem.ID, hd.Fields).Delete(&KVHashField{})
+			if result.Error != nil {
+				return result.Error
+			} else if result.RowsAffected == 0 {
+				return nil
+			}
+			res.Removed = int(result.RowsAffected)
+			res.Deleted, err = touchOrRemoveKey(tx, kvItem, &KVHashField{})
+			return err
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("hashDelete", err, w)
+			return
+		}
+		if res.Deleted {
+			kvWatchers.publish(user.ID, deletedKeyChange(kvItem))
+		} else if res.Removed > 0 {
+			kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(kvItem)})
+		}
+		res.Version = kvItem.Version
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// hashIncr adds delta to the integer stored in a hash field.
+// Missing keys and fields start at zero
+func hashIncr(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("hashIncr", err, w)
+			return
+		}
+
+		var hi HashIncrRequest
+		err = json.NewDecoder(r.Body).Decode(&hi)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if hi.Key == "" || hi.Field == "" {
+			APIUserError(w, "expected key and field to be non-empty")
+			return
+		}
+		delta := int64(1)
+		if hi.Delta != nil {
+			delta = *hi.Delta
+		}
+
+		res := HashIncrResponse{Bucket: hi.Bucket, Key: hi.Key, Field: hi.Field}
+		var kvItem *KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if kvItem, err = typedKey(tx, user, hi.Bucket, hi.Key, typeHash, true); err != nil {
+				return err
+			}
+
+			var hf KVHashField
+			err = tx.Where("kv_item_id = ? AND field = ?", kvItem.ID, hi.Field).First(&hf).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				res.Value = delta
+				err = tx.Create(&KVHashField{KVItemID: kvItem.ID, Field: hi.Field, Value: strconv.FormatInt(delta, 10)}).Error
+			} else if err == nil {
+				current, parseErr := strconv.ParseInt(hf.Value, 10, 64)
+				if parseErr != nil {
+					return newConflictError("field value is not an integer")
+				} else if incrOverflows(current, delta) {
+					return newConflictError("increment would overflow")
+				}
+				res.Value = current + delta
+				err = tx.Model(&hf).Update("value", strconv.FormatInt(res.Value, 10)).Error
+			}
+			if err != nil {
+				return err
+			}
+			return touchKey(tx, kvItem)
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError("hashIncr", err, w)
+			return
+		}
+		kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(kvItem)})
+		kvExpiry.schedule(kvItem)
+		res.Version = kvItem.Version
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHashSet(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for i, body := range []string{
+		`{"key": "some_hash", "fields": {"a": "1", "b": "2"}}`,
+		`{"key": "some_hash", "fields": {"b": "3", "c": "4"}}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/hset", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		hashSet(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var hs HashSetResponse
+		if err := json.NewDecoder(res.Body).Decode(&hs); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if hs.Added != 2-i || hs.Version != i+1 {
+			t.Errorf("expected %v added at version %v got %v", 2-i, i+1, hs)
+		}
+	}
+
+	// Check fields that weren't passed are kept
+	var kvItem KVItem
+	db.First(&kvItem)
+	if kvItem.Type != typeHash || kvItem.TTL != -1 || kvItem.Version != 2 {
+		t.Errorf("expected a hash at version 2 got %v", kvItem)
+	}
+	var fields []KVHashField
+	db.Order("field").Find(&fields)
+	if len(fields) != 3 || fields[0].Value != "1" || fields[1].Value != "3" || fields[2].Value != "4" {
+		t.Errorf("expected fields a, b, c got %v", fields)
+	}
+}
+
+func TestHashSetCreatedConcurrently(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	createConcurrently(db, &KVItem{Key: "some_hash", Value: "some_value", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	// The other writer created a string, so this is the same as writing to an existing string
+	req := httptest.NewRequest(http.MethodGet, "/kv/hset", ioutil.NopCloser(strings.NewReader(`{"key": "some_hash", "fields": {"a": "1"}}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	hashSet(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+}
+
+func TestHashSetWrongType(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "1", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/hset", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "fields": {"a": "1"}}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	hashSet(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+}
+
+func TestHashSetBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/hset", ioutil.NopCloser(strings.NewReader(`{"key": "some_hash", "fields": {"a": "1"}}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	hashSet(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestHashGet(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_hash", Type: typeHash, TTL: -1, Version: 3, UserID: int(user.ID)}
+	db.Create(kvItem)
+	db.Create(&KVHashField{KVItemID: kvItem.ID, Field: "a", Value: "1"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/hget", ioutil.NopCloser(strings.NewReader(`{"key": "some_hash", "field": "a"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	hashGet(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var hf HashField
+	if err := json.NewDecoder(res.Body).Decode(&hf); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if hf != (HashField{Key: "some_hash", Field: "a", Value: "1", Version: 3}) {
+		t.Errorf("expected field a got %v", hf)
+	}
+}
+
+func TestHashGetMissing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_hash", Type: typeHash, TTL: -1, Version: 1, UserID: int(user.ID)}
+	db.Create(kvItem)
+	db.Create(&KVHashField{KVItemID: kvItem.ID, Field: "a", Value: "1"})
+	db.Create(&KVItem{Key: "expired_hash", Type: typeHash, TTL: 1, Version: 1, UserID: int(user.ID)})
+
+	for _, body := range []string{
+		`{"key": "some_hash", "field": "b"}`,
+		`{"key": "other_hash", "field": "a"}`,
+		`{"key": "expired_hash", "field": "a"}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/hget", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		hashGet(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 404 {
+			t.Errorf("expected 404 for %v got %v", body, res.StatusCode)
+		}
+	}
+}
+
+func TestHashGetAll(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_hash", Type: typeHash, TTL: -1, Version: 2, UserID: int(user.ID)}
+	db.Create(kvItem)
+	db.Create(&KVHashField{KVItemID: kvItem.ID, Field: "a", Value: "1"})
+	db.Create(&KVHashField{KVItemID: kvItem.ID, Field: "b", Value: "2"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/hgetall", ioutil.NopCloser(strings.NewReader(`{"key": "some_hash"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	hashGetAll(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var hr HashResponse
+	if err := json.NewDecoder(res.Body).Decode(&hr); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if !reflect.DeepEqual(hr.Fields, map[string]string{"a": "1", "b": "2"}) || hr.TTL != -1 || hr.Version != 2 {
+		t.Errorf("expected fields a and b got %v", hr)
+	}
+}
+
+func TestHashGetAllWrongType(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "1", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/hgetall", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	hashGetAll(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+}
+
+func TestHashDelete(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_hash", Type: typeHash, TTL: -1, Version: 1, UserID: int(user.ID)}
+	db.Create(kvItem)
+	db.Create(&KVHashField{KVItemID: kvItem.ID, Field: "a", Value: "1"})
+	db.Create(&KVHashField{KVItemID: kvItem.ID, Field: "b", Value: "2"})
+
+	for i, expected := range []HashDeleteResponse{
+		{Key: "some_hash", Removed: 1, Version: 2},
+		{Key: "some_hash", Removed: 1, Version: 2, Deleted: true},
+	} {
+		body := `{"key": "some_hash", "fields": ["a", "c"]}`
+		if i == 1 {
+			body = `{"key": "some_hash", "fields": ["b"]}`
+		}
+		req := httptest.NewRequest(http.MethodGet, "/kv/hdel", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		hashDelete(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var hd HashDeleteResponse
+		if err := json.NewDecoder(res.Body).Decode(&hd); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if hd != expected {
+			t.Errorf("expected %v got %v", expected, hd)
+		}
+	}
+
+	// Check removing the last field removed the key
+	var count int64
+	db.Unscoped().Model(&KVItem{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected key to be removed got %v", count)
+	}
+	db.Unscoped().Model(&KVHashField{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected fields to be removed got %v", count)
+	}
+}
+
+func TestHashIncr(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for _, expected := range []int64{5, 10} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/hincr", ioutil.NopCloser(strings.NewReader(`{"key": "some_hash", "field": "a", "delta": 5}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		hashIncr(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var hi HashIncrResponse
+		if err := json.NewDecoder(res.Body).Decode(&hi); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if hi.Value != expected {
+			t.Errorf("expected %v got %v", expected, hi.Value)
+		}
+	}
+}
+
+func TestHashIncrNotInteger(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_hash", Type: typeHash, TTL: -1, Version: 1, UserID: int(user.ID)}
+	db.Create(kvItem)
+	db.Create(&KVHashField{KVItemID: kvItem.ID, Field: "a", Value: "b"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/hincr", ioutil.NopCloser(strings.NewReader(`{"key": "some_hash", "field": "a"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	hashIncr(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+}
+
+func TestSetKeyReplacesHash(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_hash", Type: typeHash, TTL: -1, Version: 1, UserID: int(user.ID)}
+	db.Create(kvItem)
+	db.Create(&KVHashField{KVItemID: kvItem.ID, Field: "a", Value: "1"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "some_hash", "value": "1"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	db.First(kvItem)
+	if kvItem.Type != typeString || kvItem.Value != "1" || kvItem.Version != 2 {
+		t.Errorf("expected key to hold a string got %v", kvItem)
+	}
+	var count int64
+	db.Unscoped().Model(&KVHashField{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected fields to be removed got %v", count)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const maxHistoryLimit = 100
+
+// recordHistory snapshots a key's new version and drops any versions
+// older than the user's history limit. Call it after every write to a key
+func recordHistory(tx *gorm.DB, user *User, kvItem *KVItem) error {
+	// Only plain strings have history, other types keep their data elsewhere
+	if kvItem.Type != typeString {
+		return nil
+	}
+	if user.HistoryLimit > 0 {
+		err := tx.Create(&KVHistory{
+			UserID:      kvItem.UserID,
+			Bucket:      kvItem.Bucket,
+			Key:         kvItem.Key,
+			Value:       kvItem.Value,
+			ContentType: kvItem.ContentType,
+			TTL:         kvItem.TTL,
+			Version:     kvItem.Version,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Unscoped().Where("user_id = ? AND bucket = ? AND key = ? AND version <= ?", kvItem.UserID, kvItem.Bucket, kvItem.Key, kvItem.Version-user.HistoryLimit).
+		Delete(&KVHistory{}).Error
+}
+
+// deleteKeyHistory is for when a key is removed, versions start again from 1 if it's recreated
+func deleteKeyHistory(tx *gorm.DB, userID uint, bucket string, key string) error {
+	return userKey(tx.Unscoped(), userID, bucket, key).Delete(&KVHistory{}).Error
+}
+
+// getKeyAt finds the version of a key that a GetKeyRequest's version or asOf points to
+func getKeyAt(db *gorm.DB, userID uint, k *GetKeyRequest) (KVItem, error) {
+	var history KVHistory
+	query := userKey(db, userID, k.Bucket, k.Key)
+	if k.Version != nil {
+		query = query.Where("version = ?", *k.Version)
+	} else {
+		query = query.Where("created_at <= ?", time.UnixMilli(int64(*k.AsOf)))
+	}
+	if err := query.Order("version DESC").First(&history).Error; err != nil {
+		return KVItem{}, err
+	}
+
+	// The version may have already expired at that point in time
+	if k.AsOf != nil && history.TTL != -1 && history.TTL < *k.AsOf {
+		return KVItem{}, gorm.ErrRecordNotFound
+	}
+	return historyKVItem(&history), nil
+}
+
+func historyKVItem(history *KVHistory) KVItem {
+	return KVItem{
+		UserID:      history.UserID,
+		Bucket:      history.Bucket,
+		Key:         history.Key,
+		Value:       history.Value,
+		ContentType: history.ContentType,
+		TTL:         history.TTL,
+		Version:     history.Version,
+	}
+}
+
+type HistoryRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+type HistoryItem struct {
+	KeyValue
+	UpdatedAt int `json:"updatedAt"` // UnixMilli
+}
+
+type HistoryResponse struct {
+	Items []HistoryItem `json:"items"` // newest first
+}
+
+func keyHistory(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("keyHistory", err, w)
+			return
+		}
+
+		var hr HistoryRequest
+		err = json.NewDecoder(r.Body).Decode(&hr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if hr.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+
+		var history []KVHistory
+		err = userKey(db, user.ID, hr.Bucket, hr.Key).Order("version DESC").Limit(maxHistoryLimit).Find(&history).Error
+		if err != nil {
+			APIServerError("keyHistory", err, w)
+			return
+		} else if len(history) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		res := HistoryResponse{Items: []HistoryItem{}}
+		for i := range history {
+			kvItem := historyKVItem(&history[i])
+			res.Items = append(res.Items, HistoryItem{KeyValue: newKeyValue(&kvItem), UpdatedAt: int(history[i].CreatedAt.UnixMilli())})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
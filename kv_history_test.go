@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyHistory(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for _, value := range []string{"v1", "v2", "v3"} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "value": "`+value+`"}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKey(db)(w, req)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/history", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	keyHistory(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var hr HistoryResponse
+	if err := json.NewDecoder(res.Body).Decode(&hr); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	// Check every version is returned newest first
+	if len(hr.Items) != 3 {
+		t.Fatalf("expected three versions got %v", len(hr.Items))
+	}
+	for i, want := range []string{"v3", "v2", "v1"} {
+		if hr.Items[i].Value != want || hr.Items[i].Version != 3-i || hr.Items[i].UpdatedAt == 0 {
+			t.Errorf("expected %v at version %v got %v", want, 3-i, hr.Items[i])
+		}
+	}
+}
+
+func TestKeyHistoryLimit(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a", HistoryLimit: 2}
+	db.Create(user)
+
+	for _, value := range []string{"v1", "v2", "v3"} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "value": "`+value+`"}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKey(db)(w, req)
+	}
+
+	// Check only the last two versions were kept
+	var history []KVHistory
+	db.Unscoped().Order("version").Find(&history)
+	if len(history) != 2 || history[0].Value != "v2" || history[1].Value != "v3" {
+		t.Errorf("expected v2 and v3 to be kept got %v", history)
+	}
+}
+
+func TestKeyHistoryMissing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/history", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	keyHistory(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
+
+func TestKeyHistoryBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/history", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	keyHistory(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestGetKeyAtVersion(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "v2", TTL: -1, Version: 2, UserID: int(user.ID)})
+	db.Create(&KVHistory{Key: "some_key", Value: "v1", TTL: -1, Version: 1, UserID: int(user.ID)})
+	db.Create(&KVHistory{Key: "some_key", Value: "v2", TTL: -1, Version: 2, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/get", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "version": 1}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	getKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var kv KeyValue
+	if err := json.NewDecoder(res.Body).Decode(&kv); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if kv.Value != "v1" || kv.Version != 1 {
+		t.Errorf("expected the first version got %v %v", kv.Value, kv.Version)
+	}
+}
+
+func TestGetKeyAsOf(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	now := time.Now()
+	db.Create(&KVItem{Key: "some_key", Value: "v2", TTL: -1, Version: 2, UserID: int(user.ID)})
+	v1 := &KVHistory{Key: "some_key", Value: "v1", TTL: -1, Version: 1, UserID: int(user.ID)}
+	v1.CreatedAt = now.Add(-time.Minute)
+	db.Create(v1)
+	v2 := &KVHistory{Key: "some_key", Value: "v2", TTL: -1, Version: 2, UserID: int(user.ID)}
+	v2.CreatedAt = now
+	db.Create(v2)
+
+	getAsOf := func(asOf time.Time) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/kv/get", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "asOf": `+strconv.FormatInt(asOf.UnixMilli(), 10)+`}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		getKey(db)(w, req)
+		return w.Result()
+	}
+
+	res := getAsOf(now.Add(-30 * time.Second))
+	defer res.Body.Close()
+	var kv KeyValue
+	if err := json.NewDecoder(res.Body).Decode(&kv); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if kv.Value != "v1" || kv.Version != 1 {
+		t.Errorf("expected the first version got %v %v", kv.Value, kv.Version)
+	}
+
+	// Check there's nothing before the first version
+	res = getAsOf(now.Add(-2 * time.Minute))
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
+
+func TestDeleteKeyDeletesHistory(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "v1", TTL: -1, Version: 1, UserID: int(user.ID)})
+	db.Create(&KVHistory{Key: "some_key", Value: "v1", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/delete", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	deleteKey(db)(w, req)
+
+	var count int64
+	db.Unscoped().Model(&KVHistory{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected history to be removed got %v items", count)
+	}
+}
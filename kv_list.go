@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+type ListPushRequest struct {
+	Bucket string   `json:"bucket"`
+	Key    string   `json:"key"`
+	Values []string `json:"values"`
+}
+
+type ListLengthResponse struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Length  int    `json:"length"`
+	Version int    `json:"version"`
+	Deleted bool   `json:"deleted,omitempty"` // set by /kv/ltrim when nothing was left
+}
+
+type ListPopRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Count  int    `json:"count"`
+}
+
+type ListPopResponse struct {
+	Bucket  string   `json:"bucket,omitempty"`
+	Key     string   `json:"key"`
+	Values  []string `json:"values"`
+	Version int      `json:"version"`
+	Deleted bool     `json:"deleted"` // the last element was popped so the key was deleted too
+}
+
+// ListRangeRequest selects elements by index, negative indexes count back from the last element
+type ListRangeRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Start  int    `json:"start"`
+	Stop   int    `json:"stop"` // inclusive
+}
+
+type ListRangeResponse struct {
+	Bucket  string   `json:"bucket,omitempty"`
+	Key     string   `json:"key"`
+	Values  []string `json:"values"`
+	Version int      `json:"version"`
+}
+
+func listOrder(left bool) string {
+	if left {
+		return "position"
+	}
+	return "position DESC"
+}
+
+func listLength(tx *gorm.DB, kvItem *KVItem) (int, error) {
+	var length int64
+	err := tx.Model(&KVListElement{}).Where("kv_item_id = ?", kvItem.ID).Count(&length).Error
+	return int(length), err
+}
+
+// listPush adds values to the left (head) or right (tail) of a list, one at a time,
+// so pushing a then b to the left leaves b first. A missing key is created with the bucket's default TTL
+func listPush(db *gorm.DB, left bool) func(http.ResponseWriter, *http.Request) {
+	route := "listRightPush"
+	if left {
+		route = "listLeftPush"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError(route, err, w)
+			return
+		}
+
+		var lp ListPushRequest
+		err = json.NewDecoder(r.Body).Decode(&lp)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if lp.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+		if len(lp.Values) == 0 || len(lp.Values) > maxBatchSize {
+			APIUserError(w, fmt.Sprintf("expected between 1 and %v values", maxBatchSize))
+			return
+		}
+
+		res := ListLengthResponse{Bucket: lp.Bucket, Key: lp.Key}
+		var kvItem *KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			bucket, err := getBucket(tx, user.ID, lp.Bucket)
+			if err != nil {
+				return err
+			}
+			for _, value := range lp.Values {
+				if bucket.MaxValueSize > 0 && len(value) > bucket.MaxValueSize {
+					return newTooLargeError(fmt.Sprintf("expected values to be at most %v bytes", bucket.MaxValueSize))
+				}
+			}
+
+			if kvItem, err = typedKey(tx, user, lp.Bucket, lp.Key, typeList, true); err != nil {
+				return err
+			}
+			// Carry on from the element at the end that's being pushed to
+			var end KVListElement
+			position := 0
+			err = tx.Where("kv_item_id = ?", kvItem.ID).Order(listOrder(left)).First(&end).Error
+			if err == nil {
+				position = end.Position
+			} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			for _, value := range lp.Values {
+				if left {
+					position--
+				} else {
+					position++
+				}
+				if err = tx.Create(&KVListElement{KVItemID: kvItem.ID, Position: position, Value: value}).Error; err != nil {
+					return err
+				}
+			}
+
+			if res.Length, err = listLength(tx, kvItem); err != nil {
+				return err
+			}
+			return touchKey(tx, kvItem)
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError(route, err, w)
+			return
+		}
+		kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(kvItem)})
+		kvExpiry.schedule(kvItem)
+		res.Version = kvItem.Version
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// listPop removes and returns up to count values from the left (head) or right (tail) of a list.
+// The key is deleted along with its last element
+func listPop(db *gorm.DB, left bool) func(http.ResponseWriter, *http.Request) {
+	route := "listRightPop"
+	if left {
+		route = "listLeftPop"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError(route, err, w)
+			return
+		}
+
+		lp := &ListPopRequest{Count: 1}
+		err = json.NewDecoder(r.Body).Decode(&lp)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if lp.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+		if lp.Count < 1 || lp.Count > maxBatchSize {
+			APIUserError(w, fmt.Sprintf("expected count to be between 1 and %v", maxBatchSize))
+			return
+		}
+
+		res := ListPopResponse{Bucket: lp.Bucket, Key: lp.Key, Values: []string{}}
+		var kvItem *KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if kvItem, err = typedKey(tx, user, lp.Bucket, lp.Key, typeList, false); err != nil {
+				return err
+			}
+			var elements []KVListElement
+			if err = tx.Where("kv_item_id = ?", kvItem.ID).Order(listOrder(left)).Limit(lp.Count).Find(&elements).Error; err != nil {
+				return err
+			}
+			ids := make([]uint, 0, len(elements))
+			for _, element := range elements {
+				res.Values = append(res.Values, element.Value)
+				ids = append(ids, element.ID)
+			}
+			if err = tx.Unscoped().Delete(&KVListElement{}, ids).Error; err != nil {
+				return err
+			}
+			res.Deleted, err = touchOrRemoveKey(tx, kvItem, &KVListElement{})
+			return err
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError(route, err, w)
+			return
+		}
+		if res.Deleted {
+			kvWatchers.publish(user.ID, deletedKeyChange(kvItem))
+		} else {
+			kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(kvItem)})
+		}
+		res.Version = kvItem.Version
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// listRange returns the values between two indexes, like Redis' LRANGE
+func listRange(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("listRange", err, w)
+			return
+		}
+
+		lr := &ListRangeRequest{Start: 0, Stop: -1}
+		err = json.NewDecoder(r.Body).Decode(&lr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if lr.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+
+		var elements []KVListElement
+		kvItem, err := liveTypedKey(db, user.ID, lr.Bucket, lr.Key, typeList)
+		if err == nil {
+			var length int
+			if length, err = listLength(db, kvItem); err != nil {
+				APIServerError("listRange", err, w)
+				return
+			}
+			start, stop := rankRange(lr.Start, lr.Stop, length)
+			if stop-start+1 > maxListLimit {
+				APIUserError(w, fmt.Sprintf("expected at most %v values in the range", maxListLimit))
+				return
+			} else if start <= stop {
+				err = db.Where("kv_item_id = ?", kvItem.ID).Order(listOrder(true)).
+					Offset(start).Limit(stop - start + 1).Find(&elements).Error
+			}
+		}
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("listRange", err, w)
+			return
+		}
+
+		res := ListRangeResponse{Bucket: kvItem.Bucket, Key: kvItem.Key, Values: []string{}, Version: kvItem.Version}
+		for _, element := range elements {
+			res.Values = append(res.Values, element.Value)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+func listLen(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("listLen", err, w)
+			return
+		}
+
+		var k Key
+		err = json.NewDecoder(r.Body).Decode(&k)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if k.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+
+		var length int
+		kvItem, err := liveTypedKey(db, user.ID, k.Bucket, k.Key, typeList)
+		if err == nil {
+			length, err = listLength(db, kvItem)
+		}
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("listLen", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&ListLengthResponse{Bucket: kvItem.Bucket, Key: kvItem.Key, Length: length, Version: kvItem.Version})
+	}
+}
+
+// listTrim keeps only the values between two indexes, like Redis' LTRIM.
+// The key is deleted if the range is empty
+func listTrim(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("listTrim", err, w)
+			return
+		}
+
+		var lt ListRangeRequest
+		err = json.NewDecoder(r.Body).Decode(&lt)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if lt.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+
+		res := ListLengthResponse{Bucket: lt.Bucket, Key: lt.Key}
+		trimmed := false
+		var kvItem *KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if kvItem, err = typedKey(tx, user, lt.Bucket, lt.Key, typeList, false); err != nil {
+				return err
+			}
+			length, err := listLength(tx, kvItem)
+			if err != nil {
+				return err
+			}
+			start, stop := rankRange(lt.Start, lt.Stop, length)
+			if start == 0 && stop == length-1 {
+				res.Length = length
+				return nil
+			}
+
+			// Delete everything outside of the positions at start and stop
+			query := tx.Unscoped().Where("kv_item_id = ?", kvItem.ID)
+			if start <= stop {
+				var first, last KVListElement
+				if err = tx.Where("kv_item_id = ?", kvItem.ID).Order(listOrder(true)).Offset(start).First(&first).Error; err != nil {
+					return err
+				} else if err = tx.Where("kv_item_id = ?", kvItem.ID).Order(listOrder(true)).Offset(stop).First(&last).Error; err != nil {
+					return err
+				}
+				query = query.Where("position < ? OR position > ?", first.Position, last.Position)
+				res.Length = stop - start + 1
+			}
+			if err = query.Delete(&KVListElement{}).Error; err != nil {
+				return err
+			}
+			trimmed = true
+			res.Deleted, err = touchOrRemoveKey(tx, kvItem, &KVListElement{})
+			return err
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("listTrim", err, w)
+			return
+		}
+		if res.Deleted {
+			kvWatchers.publish(user.ID, deletedKeyChange(kvItem))
+		} else if trimmed {
+			kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(kvItem)})
+		}
+		res.Version = kvItem.Version
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
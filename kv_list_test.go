@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// createList stores a list directly, values are in order from left to right
+func createList(db *gorm.DB, user *User, key string, values ...string) *KVItem {
+	kvItem := &KVItem{Key: key, Type: typeList, TTL: -1, Version: 1, UserID: int(user.ID)}
+	db.Create(kvItem)
+	for i, value := range values {
+		db.Create(&KVListElement{KVItemID: kvItem.ID, Position: i, Value: value})
+	}
+	return kvItem
+}
+
+func listValues(db *gorm.DB) []string {
+	var elements []KVListElement
+	db.Order("position").Find(&elements)
+	values := []string{}
+	for _, element := range elements {
+		values = append(values, element.Value)
+	}
+	return values
+}
+
+func TestListPush(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for i, push := range []struct {
+		left bool
+		body string
+	}{
+		{false, `{"key": "some_list", "values": ["c", "d"]}`},
+		{true, `{"key": "some_list", "values": ["b", "a"]}`},
+		{false, `{"key": "some_list", "values": ["e"]}`},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/rpush", ioutil.NopCloser(strings.NewReader(push.body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		listPush(db, push.left)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var ll ListLengthResponse
+		if err := json.NewDecoder(res.Body).Decode(&ll); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if ll.Length != []int{2, 4, 5}[i] || ll.Version != i+1 {
+			t.Errorf("expected length %v at version %v got %v", []int{2, 4, 5}[i], i+1, ll)
+		}
+	}
+
+	if values := listValues(db); !reflect.DeepEqual(values, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("expected a to e got %v", values)
+	}
+}
+
+func TestListPushWrongType(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "1", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/lpush", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "values": ["a"]}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	listPush(db, true)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+}
+
+func TestListPushBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/lpush", ioutil.NopCloser(strings.NewReader(`{"key": "some_list", "values": ["a"]}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	listPush(db, true)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestListPop(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	createList(db, user, "some_list", "a", "b", "c", "d")
+
+	for _, pop := range []struct {
+		left     bool
+		body     string
+		expected ListPopResponse
+	}{
+		{true, `{"key": "some_list"}`, ListPopResponse{Key: "some_list", Values: []string{"a"}, Version: 2}},
+		{false, `{"key": "some_list", "count": 2}`, ListPopResponse{Key: "some_list", Values: []string{"d", "c"}, Version: 3}},
+		{false, `{"key": "some_list", "count": 2}`, ListPopResponse{Key: "some_list", Values: []string{"b"}, Version: 3, Deleted: true}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/lpop", ioutil.NopCloser(strings.NewReader(pop.body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		listPop(db, pop.left)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var lp ListPopResponse
+		if err := json.NewDecoder(res.Body).Decode(&lp); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if !reflect.DeepEqual(lp, pop.expected) {
+			t.Errorf("expected %v got %v", pop.expected, lp)
+		}
+	}
+
+	var count int64
+	db.Unscoped().Model(&KVItem{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected key to be removed got %v", count)
+	}
+}
+
+func TestListPopMissing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/lpop", ioutil.NopCloser(strings.NewReader(`{"key": "some_list"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	listPop(db, true)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
+
+func TestListRange(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	createList(db, user, "some_list", "a", "b", "c", "d")
+
+	for body, expected := range map[string][]string{
+		`{"key": "some_list"}`:                          {"a", "b", "c", "d"},
+		`{"key": "some_list", "start": 1, "stop": 2}`:   {"b", "c"},
+		`{"key": "some_list", "start": -2, "stop": -1}`: {"c", "d"},
+		`{"key": "some_list", "start": 3, "stop": 10}`:  {"d"},
+		`{"key": "some_list", "start": 5, "stop": 10}`:  {},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/lrange", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		listRange(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 for %v got %v", body, res.StatusCode)
+		}
+		var lr ListRangeResponse
+		if err := json.NewDecoder(res.Body).Decode(&lr); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if !reflect.DeepEqual(lr.Values, expected) {
+			t.Errorf("expected %v for %v got %v", expected, body, lr.Values)
+		}
+	}
+}
+
+func TestListLen(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	createList(db, user, "some_list", "a", "b", "c")
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/llen", ioutil.NopCloser(strings.NewReader(`{"key": "some_list"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	listLen(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var ll ListLengthResponse
+	if err := json.NewDecoder(res.Body).Decode(&ll); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if ll != (ListLengthResponse{Key: "some_list", Length: 3, Version: 1}) {
+		t.Errorf("expected length 3 got %v", ll)
+	}
+}
+
+func TestListTrim(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	createList(db, user, "some_list", "a", "b", "c", "d", "e")
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/ltrim", ioutil.NopCloser(strings.NewReader(`{"key": "some_list", "start": 1, "stop": -2}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	listTrim(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var ll ListLengthResponse
+	if err := json.NewDecoder(res.Body).Decode(&ll); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if ll != (ListLengthResponse{Key: "some_list", Length: 3, Version: 2}) {
+		t.Errorf("expected length 3 at version 2 got %v", ll)
+	}
+	if values := listValues(db); !reflect.DeepEqual(values, []string{"b", "c", "d"}) {
+		t.Errorf("expected b to d got %v", values)
+	}
+
+	// Check an empty range deletes the key
+	req = httptest.NewRequest(http.MethodGet, "/kv/ltrim", ioutil.NopCloser(strings.NewReader(`{"key": "some_list", "start": 5, "stop": 10}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w = httptest.NewRecorder()
+	listTrim(db)(w, req)
+
+	res = w.Result()
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(&ll); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if !ll.Deleted || ll.Length != 0 {
+		t.Errorf("expected key to be deleted got %v", ll)
+	}
+	var count int64
+	db.Unscoped().Model(&KVListElement{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected elements to be removed got %v", count)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const maxTags = 32
+const maxTagLength = 128
+
+// KeyMetadata is returned alongside a key's value by /kv/get and, when asked for, /kv/list
+type KeyMetadata struct {
+	Tags           []string `json:"tags"`
+	CreatedAt      int      `json:"createdAt"` // UnixMilli
+	UpdatedAt      int      `json:"updatedAt"`
+	LastAccessedAt int      `json:"lastAccessedAt"` // 0 if the key has never been read
+	ReadCount      int      `json:"readCount"`
+}
+
+func newKeyMetadata(kvItem *KVItem, tags []string) *KeyMetadata {
+	if tags == nil {
+		tags = []string{}
+	}
+	return &KeyMetadata{
+		Tags:           tags,
+		CreatedAt:      int(kvItem.CreatedAt.UnixMilli()),
+		UpdatedAt:      int(kvItem.UpdatedAt.UnixMilli()),
+		LastAccessedAt: kvItem.LastAccessedAt,
+		ReadCount:      kvItem.ReadCount,
+	}
+}
+
+// checkTags returns a message describing what's wrong with tags, or "" if they're valid
+func checkTags(tags []string) string {
+	if len(tags) > maxTags {
+		return fmt.Sprintf("expected at most %v tags", maxTags)
+	}
+	for _, tag := range tags {
+		if tag == "" || len(tag) > maxTagLength {
+			return fmt.Sprintf("expected tags to be between 1 and %v bytes", maxTagLength)
+		}
+	}
+	return ""
+}
+
+// setKeyTags replaces a key's tags inside a transaction, nil leaves them as they are
+func setKeyTags(tx *gorm.DB, kvItem *KVItem, tags []string) error {
+	if tags == nil {
+		return nil
+	}
+	if err := tx.Unscoped().Where("kv_item_id = ?", kvItem.ID).Delete(&KVTag{}).Error; err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		if err := tx.Create(&KVTag{KVItemID: kvItem.ID, Tag: tag}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyTags loads the sorted tags of each of the given keys
+func keyTags(tx *gorm.DB, ids []uint) (map[uint][]string, error) {
+	var kvTags []KVTag
+	if err := tx.Where("kv_item_id IN ?", ids).Order("tag").Find(&kvTags).Error; err != nil {
+		return nil, err
+	}
+	tags := make(map[uint][]string, len(ids))
+	for _, kvTag := range kvTags {
+		tags[kvTag.KVItemID] = append(tags[kvTag.KVItemID], kvTag.Tag)
+	}
+	return tags, nil
+}
+
+// taggedKeys is a subquery that selects the IDs of keys with the given tag
+func taggedKeys(tx *gorm.DB, tag string) *gorm.DB {
+	return tx.Model(&KVTag{}).Select("kv_item_id").Where("tag = ?", tag)
+}
+
+// recordReads counts a read of each of the given keys. It doesn't change their version or updatedAt
+func recordReads(tx *gorm.DB, kvItems ...*KVItem) error {
+	if len(kvItems) == 0 {
+		return nil
+	}
+	now := int(time.Now().UnixMilli())
+	ids := make([]uint, 0, len(kvItems))
+	for _, kvItem := range kvItems {
+		ids = append(ids, kvItem.ID)
+	}
+	err := tx.Model(&KVItem{}).Where("id IN ?", ids).
+		UpdateColumns(map[string]interface{}{"read_count": gorm.Expr("read_count + 1"), "last_accessed_at": now}).Error
+	if err != nil {
+		return err
+	}
+	for _, kvItem := range kvItems {
+		kvItem.ReadCount++
+		kvItem.LastAccessedAt = now
+	}
+	return nil
+}
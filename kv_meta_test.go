@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetKeyTags(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	// Missing tags are kept and an empty list clears them
+	for _, step := range []struct {
+		body     string
+		expected []string
+	}{
+		{`{"key": "some_key", "value": "1", "tags": ["team:a", "config", "config"]}`, []string{"config", "team:a"}},
+		{`{"key": "some_key", "value": "2"}`, []string{"config", "team:a"}},
+		{`{"key": "some_key", "value": "3", "tags": []}`, []string{}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(step.body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 for %v got %v", step.body, res.StatusCode)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/kv/get", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w = httptest.NewRecorder()
+		getKey(db)(w, req)
+
+		res = w.Result()
+		defer res.Body.Close()
+		var gk GetKeyResponse
+		if err := json.NewDecoder(res.Body).Decode(&gk); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if gk.KeyMetadata == nil || strings.Join(gk.Tags, ",") != strings.Join(step.expected, ",") {
+			t.Errorf("expected tags %v after %v got %v", step.expected, step.body, gk.KeyMetadata)
+		}
+	}
+}
+
+func TestSetKeyBadTags(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for _, body := range []string{
+		`{"key": "some_key", "value": "some_value", "tags": [""]}`,
+		`{"key": "some_key", "value": "some_value", "tags": ["` + strings.Repeat("a", maxTagLength+1) + `"]}`,
+		`{"key": "some_key", "value": "some_value", "tags": [` + strings.Repeat(`"a",`, maxTags) + `"a"]}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("expected 400 got %v", res.StatusCode)
+		}
+	}
+}
+
+func TestGetKeyMetadata(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 2, UserID: int(user.ID)}
+	db.Create(kvItem)
+
+	for _, expected := range []int{1, 2} {
+		before := int(time.Now().UnixMilli())
+		req := httptest.NewRequest(http.MethodGet, "/kv/get", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		getKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var gk GetKeyResponse
+		if err := json.NewDecoder(res.Body).Decode(&gk); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if gk.KeyMetadata == nil || gk.ReadCount != expected || gk.LastAccessedAt < before {
+			t.Errorf("expected read %v to be counted got %v", expected, gk.KeyMetadata)
+		} else if gk.CreatedAt != int(kvItem.CreatedAt.UnixMilli()) || gk.UpdatedAt != int(kvItem.UpdatedAt.UnixMilli()) {
+			t.Errorf("expected createdAt and updatedAt got %v", gk.KeyMetadata)
+		}
+	}
+
+	// Check reading didn't change the version or updatedAt
+	var stored KVItem
+	db.First(&stored)
+	if stored.Version != 2 || !stored.UpdatedAt.Equal(kvItem.UpdatedAt) {
+		t.Errorf("expected reads not to count as writes got %v %v", stored.Version, stored.UpdatedAt)
+	}
+}
+
+func TestListKeysByTag(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	for _, key := range []string{"a", "b", "c"} {
+		kvItem := &KVItem{Key: key, Value: "some_value", TTL: -1, Version: 1, UserID: int(user.ID)}
+		db.Create(kvItem)
+		if key != "b" {
+			db.Create(&KVTag{KVItemID: kvItem.ID, Tag: "config"})
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/list", ioutil.NopCloser(strings.NewReader(`{"tag": "config", "metadata": true}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	listKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var kl KeyListResponse
+	if err := json.NewDecoder(res.Body).Decode(&kl); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if len(kl.Items) != 2 || kl.Items[0].Key != "a" || kl.Items[1].Key != "c" {
+		t.Fatalf("expected a and c got %v", kl.Items)
+	}
+	if kl.Items[0].KeyMetadata == nil || len(kl.Items[0].Tags) != 1 || kl.Items[0].Tags[0] != "config" {
+		t.Errorf("expected metadata with tags got %v", kl.Items[0].KeyMetadata)
+	}
+}
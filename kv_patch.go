@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+type PatchRequest struct {
+	Bucket     string          `json:"bucket"`
+	Key        string          `json:"key"`
+	MergePatch json.RawMessage `json:"mergePatch"` // RFC 7396
+	Patch      json.RawMessage `json:"patch"`      // RFC 6902
+	IfVersion  *int            `json:"ifVersion"`
+}
+
+// PatchOp is one operation of a JSON Patch
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+
+	// Filled in by checkPatchOps
+	path  []string
+	from  []string
+	value interface{}
+}
+
+// decodeJSON decodes a single JSON document, keeping numbers as they were written
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	} else if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON document")
+	}
+	return doc, nil
+}
+
+func encodeJSON(doc interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	} else if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("expected path %v to start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// checkPatchOps returns a message describing what's wrong with ops, or "" if they're valid
+func checkPatchOps(ops []PatchOp) string {
+	for i := range ops {
+		op := &ops[i]
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return fmt.Sprintf("expected op %v to have a value", i)
+			}
+			value, err := decodeJSON(op.Value)
+			if err != nil {
+				return fmt.Sprintf("expected op %v to have a valid value", i)
+			}
+			op.value = value
+		case "move", "copy":
+			if op.From == nil {
+				return fmt.Sprintf("expected op %v to have a from", i)
+			}
+			from, err := parsePointer(*op.From)
+			if err != nil {
+				return fmt.Sprintf("op %v: %v", i, err)
+			}
+			op.from = from
+		case "remove":
+		default:
+			return fmt.Sprintf("expected op %v to be add, remove, replace, move, copy or test", i)
+		}
+		if op.Path == nil {
+			return fmt.Sprintf("expected op %v to have a path", i)
+		}
+		path, err := parsePointer(*op.Path)
+		if err != nil {
+			return fmt.Sprintf("op %v: %v", i, err)
+		}
+		op.path = path
+	}
+	return ""
+}
+
+// arrayIndex parses a reference token into an index of an array of length n,
+// with end allowing "-" or n for adding to the end of the array
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if end && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') || token[0] == '+' {
+		return 0, fmt.Errorf("%v is not an array index", token)
+	} else if i > n || (!end && i == n) {
+		return 0, fmt.Errorf("array index %v is out of range", token)
+	}
+	return i, nil
+}
+
+// getPointer returns the value at path in doc
+func getPointer(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			child, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %v does not exist", token)
+			}
+			doc = child
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("%v is not inside an object or array", token)
+		}
+	}
+	return doc, nil
+}
+
+// updatePointer replaces the object or array holding the last token of path with
+// what change returns, and returns the new doc. path must not be empty
+func updatePointer(doc interface{}, path []string, change func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return change(doc, path[0])
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("member %v does not exist", path[0])
+		}
+		child, err := updatePointer(child, path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		node[path[0]] = child
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := updatePointer(node[i], path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = child
+		return node, nil
+	}
+	return nil, fmt.Errorf("%v is not inside an object or array", path[0])
+}
+
+func addPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updatePointer(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("%v is not inside an object or array", token)
+	})
+}
+
+func removePointer(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("the whole document can't be removed")
+	}
+	return updatePointer(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			if _, ok := node[token]; !ok {
+				return nil, fmt.Errorf("member %v does not exist", token)
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%v is not inside an object or array", token)
+	})
+}
+
+// copyJSON deep copies a decoded document so the copy can be changed on its own
+func copyJSON(doc interface{}) interface{} {
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(node))
+		for k, v := range node {
+			copied[k] = copyJSON(v)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(node))
+		for i, v := range node {
+			copied[i] = copyJSON(v)
+		}
+		return copied
+	}
+	return doc
+}
+
+// equalJSON compares decoded documents, where numbers are equal if they have the same value
+func equalJSON(a interface{}, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, ok := y[k]; !ok || !equalJSON(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equalJSON(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		xf, xErr := x.Float64()
+		yf, yErr := y.Float64()
+		return x == y || (xErr == nil && yErr == nil && xf == yf)
+	}
+	return a == b
+}
+
+// applyJSONPatch applies RFC 6902 operations in order, stopping at the first one that fails
+func applyJSONPatch(doc interface{}, ops []PatchOp) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "add":
+			doc, err = addPointer(doc, op.path, copyJSON(op.value))
+		case "remove":
+			doc, err = removePointer(doc, op.path)
+		case "replace":
+			if _, err = getPointer(doc, op.path); err == nil {
+				if len(op.path) == 0 {
+					doc = copyJSON(op.value)
+				} else if doc, err = removePointer(doc, op.path); err == nil {
+					doc, err = addPointer(doc, op.path, copyJSON(op.value))
+				}
+			}
+		case "move":
+			if len(op.path) > len(op.from) && strings.HasPrefix(*op.Path, *op.From+"/") {
+				err = errors.New("a value can't be moved into itself")
+				break
+			}
+			var value interface{}
+			if value, err = getPointer(doc, op.from); err == nil {
+				if doc, err = removePointer(doc, op.from); err == nil {
+					doc, err = addPointer(doc, op.path, value)
+				}
+			}
+		case "copy":
+			var value interface{}
+			if value, err = getPointer(doc, op.from); err == nil {
+				doc, err = addPointer(doc, op.path, copyJSON(value))
+			}
+		case "test":
+			var value interface{}
+			if value, err = getPointer(doc, op.path); err == nil && !equalJSON(value, op.value) {
+				err = fmt.Errorf("value at %v is not the expected value", *op.Path)
+			}
+		}
+		if err != nil {
+			return nil, newUnprocessableError(fmt.Sprintf("op %v (%v) failed: %v", i, op.Op, err))
+		}
+	}
+	return doc, nil
+}
+
+// applyMergePatch applies an RFC 7396 merge patch
+func applyMergePatch(doc interface{}, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	target, ok := doc.(map[string]interface{})
+	if !ok {
+		target = map[string]interface{}{}
+	}
+	for k, v := range fields {
+		if v == nil {
+			delete(target, k)
+		} else {
+			target[k] = applyMergePatch(target[k], v)
+		}
+	}
+	return target
+}
+
+// patchKey changes part of a key's JSON value. The key is read and written in one
+// transaction, so unlike reading then setting the whole value, concurrent patches aren't lost
+func patchKey(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("patchKey", err, w)
+			return
+		}
+
+		var pr PatchRequest
+		err = json.NewDecoder(r.Body).Decode(&pr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if pr.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+		if (len(pr.MergePatch) == 0) == (len(pr.Patch) == 0) {
+			APIUserError(w, "expected exactly one of mergePatch and patch")
+			return
+		}
+		// A null patch unmarshals into nil ops without an error, so it's rejected here rather
+		// than being mistaken for a mergePatch
+		jsonPatch := len(pr.Patch) > 0
+		var ops []PatchOp
+		var mergePatch interface{}
+		if jsonPatch {
+			if err = json.Unmarshal(pr.Patch, &ops); err != nil || ops == nil {
+				APIUserError(w, "expected patch to be a list of operations")
+				return
+			} else if msg := checkPatchOps(ops); msg != "" {
+				APIUserError(w, msg)
+				return
+			}
+		} else if mergePatch, err = decodeJSON(pr.MergePatch); err != nil {
+			APIUserError(w, "error parsing mergePatch")
+			return
+		}
+
+		var kvItem KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := liveKey(tx, user.ID, pr.Bucket, pr.Key).First(&kvItem).Error; err != nil {
+				return err
+			} else if kvItem.Type != typeString {
+				return wrongTypeError(&kvItem)
+			} else if pr.IfVersion != nil && kvItem.Version != *pr.IfVersion {
+				return newConflictError("key version does not match")
+			}
+
+			doc, err := decodeJSON([]byte(kvItem.Value))
+			if err != nil {
+				return newUnprocessableError("value is not valid JSON")
+			}
+			if jsonPatch {
+				if doc, err = applyJSONPatch(doc, ops); err != nil {
+					return err
+				}
+			} else {
+				doc = applyMergePatch(doc, mergePatch)
+			}
+			value, err := encodeJSON(doc)
+			if err != nil {
+				return err
+			}
+			return updateKeyValue(tx, user, &kvItem, value)
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("patchKey", err, w)
+			return
+		}
+		kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(&kvItem)})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		res := newKeyValue(&kvItem)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// updateKeyValue changes the value of a string key inside a transaction, keeping its TTL and content type.
+// The new value is checked against the bucket's size limit and the key's schemas
+func updateKeyValue(tx *gorm.DB, user *User, kvItem *KVItem, value string) error {
+	bucket, err := getBucket(tx, user.ID, kvItem.Bucket)
+	if err != nil {
+		return err
+	} else if bucket.MaxValueSize > 0 && len(value) > bucket.MaxValueSize {
+		return newTooLargeError(fmt.Sprintf("expected value to be at most %v bytes", bucket.MaxValueSize))
+	}
+	if err = checkKeySchemas(tx, user.ID, kvItem.Bucket, kvItem.Key, value); err != nil {
+		return err
+	}
+
+	result := tx.Model(&KVItem{}).Where("id = ? AND version = ?", kvItem.ID, kvItem.Version).
+		Updates(map[string]interface{}{"value": value, "version": kvItem.Version + 1})
+	if result.Error != nil {
+		return result.Error
+	} else if result.RowsAffected == 0 {
+		return newConflictError("key was modified concurrently")
+	}
+	kvItem.Value, kvItem.Version = value, kvItem.Version+1
+	if err := keyEvent(tx, eventOpSet, kvItem, kvItem.Version-1); err != nil {
+		return err
+	}
+	return recordHistory(tx, user, kvItem)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPatchKeyMergePatch(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: `{"a":1,"b":{"c":2,"d":3},"e":"<x>"}`, TTL: 4102444800000, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/patch", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "mergePatch": {"a": null, "b": {"c": 4}, "f": [1.50]}}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	patchKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var kv KeyValue
+	if err := json.NewDecoder(res.Body).Decode(&kv); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	expected := `{"b":{"c":4,"d":3},"e":"<x>","f":[1.50]}`
+	if kv.Value != expected || kv.Version != 2 || kv.TTL != 4102444800000 {
+		t.Errorf("expected %v at version 2 with its TTL got %v", expected, kv)
+	}
+}
+
+func TestPatchKeyJSONPatch(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: `{"a/b":1,"list":[1,2,3],"obj":{"x":"y"}}`, TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	patch := `[
+		{"op": "test", "path": "/a~1b", "value": 1.0},
+		{"op": "add", "path": "/list/-", "value": 4},
+		{"op": "add", "path": "/list/0", "value": 0},
+		{"op": "remove", "path": "/list/1"},
+		{"op": "replace", "path": "/a~1b", "value": true},
+		{"op": "copy", "from": "/obj", "path": "/copied"},
+		{"op": "move", "from": "/obj/x", "path": "/moved"}
+	]`
+	req := httptest.NewRequest(http.MethodGet, "/kv/patch", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "ifVersion": 1, "patch": `+patch+`}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	patchKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var kv KeyValue
+	if err := json.NewDecoder(res.Body).Decode(&kv); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	expected := `{"a/b":true,"copied":{"x":"y"},"list":[0,2,3,4],"moved":"y","obj":{}}`
+	if kv.Value != expected || kv.Version != 2 {
+		t.Errorf("expected %v at version 2 got %v", expected, kv)
+	}
+}
+
+func TestPatchKeyFailedOp(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: `{"a":1}`, TTL: -1, Version: 1, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "not_json", Value: "some_value", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	for _, body := range []string{
+		`{"key": "some_key", "patch": [{"op": "add", "path": "/b", "value": 2}, {"op": "test", "path": "/a", "value": 2}]}`,
+		`{"key": "some_key", "patch": [{"op": "remove", "path": "/missing"}]}`,
+		`{"key": "some_key", "patch": [{"op": "add", "path": "/a/b", "value": 2}]}`,
+		`{"key": "not_json", "mergePatch": {"a": 1}}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/patch", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		patchKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 422 {
+			t.Errorf("expected 422 for %v got %v", body, res.StatusCode)
+		}
+	}
+
+	// Check a failed patch didn't change the key
+	var kvItem KVItem
+	db.Where("key = ?", "some_key").First(&kvItem)
+	if kvItem.Value != `{"a":1}` || kvItem.Version != 1 {
+		t.Errorf("expected the key to be unchanged got %v %v", kvItem.Value, kvItem.Version)
+	}
+}
+
+func TestPatchKeyBadRequest(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: `{"a":1}`, TTL: -1, UserID: int(user.ID)})
+
+	for _, body := range []string{
+		`{"key": "some_key"}`,
+		`{"key": "some_key", "mergePatch": {}, "patch": []}`,
+		`{"key": "some_key", "patch": {"op": "add"}}`,
+		`{"key": "some_key", "patch": null}`,
+		`{"key": "some_key", "patch": "[]"}`,
+		`{"key": "some_key", "patch": [{"op": "merge", "path": "/a"}]}`,
+		`{"key": "some_key", "patch": [{"op": "add", "path": "/a"}]}`,
+		`{"key": "some_key", "patch": [{"op": "move", "path": "/a"}]}`,
+		`{"key": "some_key", "patch": [{"op": "remove", "path": "a"}]}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/patch", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		patchKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("expected 400 for %v got %v", body, res.StatusCode)
+		}
+	}
+
+	// Check the value was left alone
+	kvItem := &KVItem{}
+	db.First(kvItem)
+	if kvItem.Value != `{"a":1}` {
+		t.Errorf("expected value to be unchanged got %v", kvItem.Value)
+	}
+}
+
+func TestPatchKeyMissing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/patch", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "mergePatch": {"a": 1}}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	patchKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
+
+func TestPatchKeyBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/patch", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "mergePatch": {"a": 1}}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	patchKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxQueryFilters = 16
+
+// queryPath matches the subset of SQLite JSON paths that /kv/query accepts, e.g. $.user.name, $.tags[0], $."a-b"
+var queryPath = regexp.MustCompile(`^\$(\.[A-Za-z0-9_]+|\."[^"]*"|\[[0-9]+\])*$`)
+
+// Values that aren't valid JSON are treated as not having any path, rather than failing the whole query
+const jsonExtractSQL = "CASE WHEN json_valid(value) THEN json_extract(value, ?) END"
+const jsonTypeSQL = "CASE WHEN json_valid(value) THEN json_type(value, ?) END"
+
+type QueryFilter struct {
+	Path  string          `json:"path"`
+	Op    string          `json:"op"` // eq, lt, lte, gt, gte or exists
+	Value json.RawMessage `json:"value"`
+}
+
+type QueryRequest struct {
+	Bucket  string        `json:"bucket"`
+	Prefix  string        `json:"prefix"`
+	Where   []QueryFilter `json:"where"`
+	OrderBy string        `json:"orderBy"` // a path, keys are sorted by key when empty
+	Desc    bool          `json:"desc"`
+	Cursor  string        `json:"cursor"`
+	Limit   int           `json:"limit"`
+}
+
+type QueryResponse struct {
+	Items  []KeyValue `json:"items"`
+	Cursor string     `json:"cursor"` // empty when there are no more keys
+}
+
+// queryCursor is the position of the last key of a page sorted by a path
+type queryCursor struct {
+	Key   string      `json:"k"`
+	Value interface{} `json:"v"`
+}
+
+// sqlValue converts a decoded JSON scalar into the value json_extract would return for it
+func sqlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []byte:
+		return string(v)
+	}
+	return value
+}
+
+// filterCondition returns the SQL and arguments that check one filter,
+// or a message describing what's wrong with the filter
+func filterCondition(filter QueryFilter) (string, []interface{}, string) {
+	if !queryPath.MatchString(filter.Path) {
+		return "", nil, fmt.Sprintf("expected path %v to look like $.some.path or $.list[0]", filter.Path)
+	}
+	if filter.Op == "exists" {
+		if len(filter.Value) > 0 {
+			return "", nil, "expected exists to not have a value"
+		}
+		return jsonTypeSQL + " IS NOT NULL", []interface{}{filter.Path}, ""
+	}
+
+	var op string
+	switch filter.Op {
+	case "eq":
+		op = "="
+	case "lt":
+		op = "<"
+	case "lte":
+		op = "<="
+	case "gt":
+		op = ">"
+	case "gte":
+		op = ">="
+	default:
+		return "", nil, fmt.Sprintf("expected op %v to be eq, lt, lte, gt, gte or exists", filter.Op)
+	}
+	if len(filter.Value) == 0 {
+		return "", nil, fmt.Sprintf("expected %v to have a value", filter.Op)
+	}
+	value, err := decodeJSON(filter.Value)
+	if err != nil {
+		return "", nil, "error parsing value"
+	}
+
+	// Check the type too so that e.g. true doesn't equal 1 and "2" isn't compared to 2
+	switch v := value.(type) {
+	case string:
+		return jsonTypeSQL + " = 'text' AND " + jsonExtractSQL + " " + op + " ?", []interface{}{filter.Path, filter.Path, v}, ""
+	case json.Number:
+		return jsonTypeSQL + " IN ('integer', 'real') AND " + jsonExtractSQL + " " + op + " ?", []interface{}{filter.Path, filter.Path, sqlValue(v)}, ""
+	case bool, nil:
+		if op != "=" {
+			break
+		}
+		typ := "null"
+		if v != nil {
+			typ = fmt.Sprint(v)
+		}
+		return jsonTypeSQL + " = ?", []interface{}{filter.Path, typ}, ""
+	}
+	if op == "=" {
+		return "", nil, "expected eq to have a string, number, boolean or null value"
+	}
+	return "", nil, fmt.Sprintf("expected %v to have a string or number value", filter.Op)
+}
+
+// queryKeys finds the JSON values in a bucket that match every filter. It scans
+// the bucket (or the keys with the prefix), so narrowing by prefix keeps it fast
+func queryKeys(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("queryKeys", err, w)
+			return
+		}
+
+		qr := &QueryRequest{Limit: defaultListLimit}
+		err = json.NewDecoder(r.Body).Decode(&qr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if qr.Limit < 1 || qr.Limit > maxListLimit {
+			APIUserError(w, fmt.Sprintf("expected limit to be between 1 and %v", maxListLimit))
+			return
+		}
+		if len(qr.Where) > maxQueryFilters {
+			APIUserError(w, fmt.Sprintf("expected at most %v filters", maxQueryFilters))
+			return
+		}
+		if qr.OrderBy != "" && !queryPath.MatchString(qr.OrderBy) {
+			APIUserError(w, fmt.Sprintf("expected orderBy %v to look like $.some.path or $.list[0]", qr.OrderBy))
+			return
+		}
+		rawCursor, err := base64.RawURLEncoding.DecodeString(qr.Cursor)
+		if err != nil {
+			APIUserError(w, "invalid cursor")
+			return
+		}
+		var after *queryCursor
+		if len(rawCursor) > 0 {
+			after = &queryCursor{Key: string(rawCursor)}
+			if qr.OrderBy != "" {
+				dec := json.NewDecoder(bytes.NewReader(rawCursor))
+				dec.UseNumber()
+				if err = dec.Decode(after); err != nil {
+					APIUserError(w, "invalid cursor")
+					return
+				}
+				after.Value = sqlValue(after.Value)
+			}
+		}
+
+		query := liveKeys(db, user.ID, qr.Bucket).Where("type = ?", typeString)
+		if qr.Prefix != "" {
+			query = query.Where("key >= ?", qr.Prefix)
+			if end := prefixEnd(qr.Prefix); end != "" {
+				query = query.Where("key < ?", end)
+			}
+		}
+		for _, filter := range qr.Where {
+			sql, args, msg := filterCondition(filter)
+			if msg != "" {
+				APIUserError(w, msg)
+				return
+			}
+			query = query.Where(sql, args...)
+		}
+
+		// Keys with the same sort value (or without one) are ordered by key, and the cursor
+		// holds both so that pages don't skip or repeat them. SQLite sorts NULLs first
+		keyOp, direction := ">", "ASC"
+		if qr.Desc {
+			keyOp, direction = "<", "DESC"
+		}
+		var order clause.Expr
+		if qr.OrderBy == "" {
+			order = clause.Expr{SQL: "key " + direction}
+			if after != nil {
+				query = query.Where("key "+keyOp+" ?", after.Key)
+			}
+		} else {
+			order = clause.Expr{SQL: jsonExtractSQL + " " + direction + ", key " + direction, Vars: []interface{}{qr.OrderBy}}
+			if after != nil {
+				switch {
+				case after.Value == nil && !qr.Desc:
+					query = query.Where("("+jsonExtractSQL+" IS NOT NULL OR key > ?)", qr.OrderBy, after.Key)
+				case after.Value == nil:
+					query = query.Where(jsonExtractSQL+" IS NULL AND key < ?", qr.OrderBy, after.Key)
+				default:
+					cond := "(" + jsonExtractSQL + " " + keyOp + " ? OR (" + jsonExtractSQL + " = ? AND key " + keyOp + " ?)"
+					if qr.Desc {
+						cond += " OR " + jsonExtractSQL + " IS NULL"
+					}
+					args := []interface{}{qr.OrderBy, after.Value, qr.OrderBy, after.Value, after.Key}
+					if qr.Desc {
+						args = append(args, qr.OrderBy)
+					}
+					query = query.Where(cond+")", args...)
+				}
+			}
+		}
+
+		// Fetch one extra item to find out if there's another page
+		var kvItems []KVItem
+		err = query.Clauses(clause.OrderBy{Expression: order}).Limit(qr.Limit + 1).Find(&kvItems).Error
+		if err != nil {
+			APIServerError("queryKeys", err, w)
+			return
+		}
+
+		res := QueryResponse{Items: make([]KeyValue, 0, len(kvItems))}
+		if len(kvItems) > qr.Limit {
+			kvItems = kvItems[:qr.Limit]
+			last := kvItems[len(kvItems)-1]
+			cursor := []byte(last.Key)
+			if qr.OrderBy != "" {
+				var value interface{}
+				err = db.Model(&KVItem{}).Select(jsonExtractSQL, qr.OrderBy).Where("id = ?", last.ID).Row().Scan(&value)
+				if err == nil {
+					cursor, err = json.Marshal(queryCursor{Key: last.Key, Value: sqlValue(value)})
+				}
+				if err != nil {
+					APIServerError("queryKeys", err, w)
+					return
+				}
+			}
+			res.Cursor = base64.RawURLEncoding.EncodeToString(cursor)
+		}
+		for i := range kvItems {
+			res.Items = append(res.Items, newKeyValue(&kvItems[i]))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
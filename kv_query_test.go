@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQueryKeys(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	for key, value := range map[string]string{
+		"user:a": `{"status": "active", "age": 30, "admin": true}`,
+		"user:b": `{"status": "inactive", "age": 40}`,
+		"user:c": `{"status": "active", "age": 20.5}`,
+		"user:d": `{"status": "active", "age": "50"}`,
+		"user:e": "not json",
+		"other":  `{"status": "active", "age": 30}`,
+	} {
+		db.Create(&KVItem{Key: key, Value: value, TTL: -1, Version: 1, UserID: int(user.ID)})
+	}
+
+	for _, step := range []struct {
+		body     string
+		expected []string
+	}{
+		{`{"prefix": "user:", "where": [{"path": "$.status", "op": "eq", "value": "active"}]}`, []string{"user:a", "user:c", "user:d"}},
+		{`{"prefix": "user:", "where": [{"path": "$.age", "op": "gte", "value": 20.5}, {"path": "$.age", "op": "lt", "value": 40}]}`, []string{"user:a", "user:c"}},
+		{`{"prefix": "user:", "where": [{"path": "$.admin", "op": "exists"}]}`, []string{"user:a"}},
+		{`{"prefix": "user:", "where": [{"path": "$.admin", "op": "eq", "value": true}]}`, []string{"user:a"}},
+		{`{"prefix": "user:", "where": [{"path": "$.age", "op": "eq", "value": "50"}]}`, []string{"user:d"}},
+		{`{"where": [{"path": "$.status", "op": "eq", "value": "active"}], "desc": true}`, []string{"user:d", "user:c", "user:a", "other"}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/query", ioutil.NopCloser(strings.NewReader(step.body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		queryKeys(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 for %v got %v", step.body, res.StatusCode)
+		}
+		var qr QueryResponse
+		if err := json.NewDecoder(res.Body).Decode(&qr); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		keys := []string{}
+		for _, item := range qr.Items {
+			keys = append(keys, item.Key)
+		}
+		if strings.Join(keys, ",") != strings.Join(step.expected, ",") {
+			t.Errorf("expected %v for %v got %v", step.expected, step.body, keys)
+		}
+	}
+}
+
+func TestQueryKeysOrderBy(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	for key, value := range map[string]string{
+		"a": `{"rank": 2}`,
+		"b": `{"rank": 1}`,
+		"c": `{"rank": 2}`,
+		"d": `{}`,
+		"e": `{"rank": 1.5}`,
+		"f": `{}`,
+	} {
+		db.Create(&KVItem{Key: key, Value: value, TTL: -1, Version: 1, UserID: int(user.ID)})
+	}
+
+	// Page through one key at a time so that ties and keys without a rank cross pages
+	for _, step := range []struct {
+		desc     string
+		expected []string
+	}{
+		{"false", []string{"d", "f", "b", "e", "a", "c"}},
+		{"true", []string{"c", "a", "e", "b", "f", "d"}},
+	} {
+		keys := []string{}
+		cursor := ""
+		for i := 0; i < 10; i++ {
+			body := `{"orderBy": "$.rank", "desc": ` + step.desc + `, "limit": 1, "cursor": "` + cursor + `"}`
+			req := httptest.NewRequest(http.MethodGet, "/kv/query", ioutil.NopCloser(strings.NewReader(body)))
+			req.Header.Set("Authorization", "Bearer "+user.Token)
+			w := httptest.NewRecorder()
+			queryKeys(db)(w, req)
+
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != 200 {
+				t.Fatalf("expected 200 got %v", res.StatusCode)
+			}
+			var qr QueryResponse
+			if err := json.NewDecoder(res.Body).Decode(&qr); err != nil {
+				t.Errorf("expected error to be nil got %v", err)
+			}
+			for _, item := range qr.Items {
+				keys = append(keys, item.Key)
+			}
+			if cursor = qr.Cursor; cursor == "" {
+				break
+			}
+		}
+		if strings.Join(keys, ",") != strings.Join(step.expected, ",") {
+			t.Errorf("expected %v with desc %v got %v", step.expected, step.desc, keys)
+		}
+	}
+}
+
+func TestQueryKeysBadRequest(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for _, body := range []string{
+		`{"where": [{"path": "status", "op": "eq", "value": "active"}]}`,
+		`{"where": [{"path": "$.status", "op": "like", "value": "active"}]}`,
+		`{"where": [{"path": "$.status", "op": "eq"}]}`,
+		`{"where": [{"path": "$.status", "op": "eq", "value": {"a": 1}}]}`,
+		`{"where": [{"path": "$.status", "op": "gt", "value": true}]}`,
+		`{"where": [{"path": "$.status", "op": "exists", "value": 1}]}`,
+		`{"orderBy": "$.a b"}`,
+		`{"orderBy": "$.a", "cursor": "bm90IGpzb24"}`,
+		`{"limit": 0}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/query", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		queryKeys(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("expected 400 for %v got %v", body, res.StatusCode)
+		}
+	}
+}
+
+func TestQueryKeysBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/query", ioutil.NopCloser(strings.NewReader(`{}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	queryKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
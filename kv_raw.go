@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const maxRawValueSize = 10 << 20 // 10MiB
+
+const defaultContentType = "application/octet-stream"
+
+// rawKey stores and returns values as raw bytes, so binary data doesn't have
+// to be base64 encoded by the caller. The key is the rest of the path after /kv/raw/
+//
+// Both take an optional bucket query parameter
+// PUT takes optional ttl and ttlMs query parameters and returns the same JSON as /kv/set
+// GET returns the stored bytes with their content type and the version as an ETag
+func rawKey(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("rawKey", err, w)
+			return
+		}
+
+		key := strings.TrimPrefix(r.URL.Path, "/kv/raw/")
+		if key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+
+		bucket := r.URL.Query().Get("bucket")
+		switch r.Method {
+		case http.MethodPut:
+			putRawKey(db, user, bucket, key, w, r)
+		case http.MethodGet:
+			getRawKey(db, user, bucket, key, w)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func putRawKey(db *gorm.DB, user *User, bucket string, key string, w http.ResponseWriter, r *http.Request) {
+	kv := &SetKeyRequest{KeyValue: KeyValue{Bucket: bucket, Key: key, TTL: -1, ContentType: r.Header.Get("Content-Type")}}
+	if kv.ContentType == "" {
+		kv.ContentType = defaultContentType
+	}
+	query := r.URL.Query()
+	if ttl := query.Get("ttl"); ttl != "" {
+		parsed, err := strconv.Atoi(ttl)
+		if err != nil {
+			APIUserError(w, "expected ttl to be an integer")
+			return
+		}
+		kv.TTL, kv.ttlSet = parsed, true
+	}
+	if ttlMs := query.Get("ttlMs"); ttlMs != "" {
+		parsed, err := strconv.Atoi(ttlMs)
+		if err != nil {
+			APIUserError(w, "expected ttlMs to be an integer")
+			return
+		}
+		kv.TTLMs = &parsed
+	}
+	if msg := prepareSetKeyRequest(kv); msg != "" {
+		APIUserError(w, msg)
+		return
+	}
+
+	value, err := io.ReadAll(io.LimitReader(r.Body, maxRawValueSize+1))
+	if err != nil {
+		APIUserError(w, "error reading body")
+		return
+	} else if len(value) > maxRawValueSize {
+		apiErrorMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("expected value to be at most %v bytes", maxRawValueSize))
+		return
+	}
+	kv.Value = string(value)
+
+	var kvItem *KVItem
+	err = retryKeyWrites(db, func(tx *gorm.DB) error {
+		kvItem, err = writeKey(tx, user, kv)
+		return err
+	})
+	if rErr, ok := err.(*requestError); ok {
+		apiRequestError(w, rErr)
+		return
+	} else if err != nil {
+		APIServerError("rawKey", err, w)
+		return
+	}
+	kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(kvItem)})
+	kvExpiry.schedule(kvItem)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&KeyVersion{Bucket: kvItem.Bucket, Key: kvItem.Key, Version: kvItem.Version})
+}
+
+func getRawKey(db *gorm.DB, user *User, bucket string, key string, w http.ResponseWriter) {
+	var kvItem KVItem
+	err := liveKey(db, user.ID, bucket, key).First(&kvItem).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		APIServerError("rawKey", err, w)
+		return
+	} else if kvItem.Type != typeString {
+		rErr := wrongTypeError(&kvItem)
+		apiRequestError(w, rErr)
+		return
+	} else if err = recordReads(db, &kvItem); err != nil {
+		APIServerError("rawKey", err, w)
+		return
+	}
+
+	contentType := kvItem.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(kvItem.Value)))
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(kvItem.Version)))
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, kvItem.Value)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPutRawKey(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	value := []byte{0x00, 0xff, 0xfe, 'a', 0x00}
+	req := httptest.NewRequest(http.MethodPut, "/kv/raw/some/key?ttl=1986589728969", bytes.NewReader(value))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	req.Header.Set("Content-Type", "image/png")
+	w := httptest.NewRecorder()
+	rawKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	var kvItem KVItem
+	db.First(&kvItem)
+	if kvItem.Key != "some/key" || !bytes.Equal([]byte(kvItem.Value), value) || kvItem.ContentType != "image/png" || kvItem.TTL != 1986589728969 {
+		t.Errorf("expected item to be created correctly got %v %v %v %v", kvItem.Key, []byte(kvItem.Value), kvItem.ContentType, kvItem.TTL)
+	}
+}
+
+func TestGetRawKey(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	value := string([]byte{0x00, 0xff, 0xfe, 'a', 0x00})
+	db.Create(&KVItem{Key: "some_key", Value: value, ContentType: "image/png", TTL: -1, Version: 3, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/raw/some_key", nil)
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	rawKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	// Check the exact bytes and headers are returned
+	if string(data) != value {
+		t.Errorf("expected %v got %v", []byte(value), data)
+	}
+	if res.Header.Get("Content-Type") != "image/png" || res.Header.Get("ETag") != `"3"` {
+		t.Errorf("expected content type and etag got %v %v", res.Header.Get("Content-Type"), res.Header.Get("ETag"))
+	}
+}
+
+func TestGetRawKeyMissing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/raw/some_key", nil)
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	rawKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
+
+func TestRawKeyBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodPut, "/kv/raw/some_key", strings.NewReader("some_value"))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	rawKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestGetKeyBinaryValue(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	value := string([]byte{0x00, 0xff, 0xfe})
+	db.Create(&KVItem{Key: "some_key", Value: value, ContentType: "image/png", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/get", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	getKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	var kv KeyValue
+	if err := json.NewDecoder(res.Body).Decode(&kv); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	// Check the value is base64 encoded and the content type is returned
+	if kv.Value != base64.StdEncoding.EncodeToString([]byte(value)) || kv.Encoding != "base64" || kv.ContentType != "image/png" {
+		t.Errorf("expected encoded value and content type got %v %v %v", kv.Value, kv.Encoding, kv.ContentType)
+	}
+}
+
+func TestSetKeyBase64Value(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "value": "AP/+", "encoding": "base64", "contentType": "image/png"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	var kvItem KVItem
+	db.First(&kvItem)
+	if kvItem.Value != string([]byte{0x00, 0xff, 0xfe}) || kvItem.ContentType != "image/png" {
+		t.Errorf("expected value to be decoded got %v %v", []byte(kvItem.Value), kvItem.ContentType)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+const maxSchemaSize = 64 * 1024
+
+// maxSchemaViolations bounds how many violations are returned for one value
+const maxSchemaViolations = 100
+
+var schemaTypeNames = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// propertyName matches property names that don't need quoting in a violation's path
+var propertyName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// schemaTypes is a JSON Schema type, which can be one type or a list of them
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return errors.New("expected type to be a string or a list of strings")
+	}
+	*t = many
+	return nil
+}
+
+// jsonSchema is the subset of JSON Schema that keys can be checked against
+type jsonSchema struct {
+	Schema      string                 `json:"$schema"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	Type        schemaTypes            `json:"type"`
+	Enum        []json.RawMessage      `json:"enum"`
+	Required    []string               `json:"required"`
+	Properties  map[string]*jsonSchema `json:"properties"`
+	Items       *jsonSchema            `json:"items"`
+	Minimum     *float64               `json:"minimum"`
+	Maximum     *float64               `json:"maximum"`
+	MinLength   *int                   `json:"minLength"`
+	MaxLength   *int                   `json:"maxLength"`
+	MinItems    *int                   `json:"minItems"`
+	MaxItems    *int                   `json:"maxItems"`
+
+	// Filled in by check
+	enum []interface{}
+}
+
+// parseSchema rejects keywords outside of the supported subset, rather than ignoring them,
+// so a schema can't look stricter than it is
+func parseSchema(data []byte) (*jsonSchema, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var schema jsonSchema
+	if err := dec.Decode(&schema); err != nil {
+		return nil, fmt.Errorf("error parsing schema: %v", err)
+	}
+	if err := schema.check("$"); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+func (s *jsonSchema) check(path string) error {
+	for _, typ := range s.Type {
+		known := false
+		for _, name := range schemaTypeNames {
+			known = known || typ == name
+		}
+		if !known {
+			return fmt.Errorf("%v: expected type to be one of %v", path, strings.Join(schemaTypeNames, ", "))
+		}
+	}
+	if s.Enum != nil {
+		s.enum = make([]interface{}, 0, len(s.Enum))
+		for _, raw := range s.Enum {
+			value, err := decodeJSON(raw)
+			if err != nil {
+				return fmt.Errorf("%v: error parsing enum", path)
+			}
+			s.enum = append(s.enum, value)
+		}
+	}
+	for _, limit := range []*int{s.MinLength, s.MaxLength, s.MinItems, s.MaxItems} {
+		if limit != nil && *limit < 0 {
+			return fmt.Errorf("%v: expected lengths to be at least 0", path)
+		}
+	}
+	for name, property := range s.Properties {
+		if property == nil {
+			return fmt.Errorf("%v: expected a schema", propertyPath(path, name))
+		} else if err := property.check(propertyPath(path, name)); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.check(path + "[]")
+	}
+	return nil
+}
+
+func propertyPath(path string, name string) string {
+	if propertyName.MatchString(name) {
+		return path + "." + name
+	}
+	return path + "." + fmt.Sprintf("%q", name)
+}
+
+// jsonTypeName returns the JSON Schema type of a decoded value, whole numbers are integers
+func jsonTypeName(doc interface{}) string {
+	switch v := doc.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+	}
+	return "number"
+}
+
+// validate appends a description of each way doc doesn't match the schema to violations
+func (s *jsonSchema) validate(doc interface{}, path string, violations []string) []string {
+	if len(s.Type) > 0 {
+		typ := jsonTypeName(doc)
+		matches := false
+		for _, expected := range s.Type {
+			matches = matches || expected == typ || (expected == "number" && typ == "integer")
+		}
+		if !matches {
+			return append(violations, fmt.Sprintf("%v: expected %v got %v", path, strings.Join(s.Type, " or "), typ))
+		}
+	}
+	if s.enum != nil {
+		found := false
+		for _, value := range s.enum {
+			found = found || equalJSON(doc, value)
+		}
+		if !found {
+			options := make([]string, 0, len(s.Enum))
+			for _, raw := range s.Enum {
+				options = append(options, string(raw))
+			}
+			violations = append(violations, fmt.Sprintf("%v: expected one of %v", path, strings.Join(options, ", ")))
+		}
+	}
+
+	switch v := doc.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			violations = append(violations, fmt.Sprintf("%v: expected at least %v got %v", path, *s.Minimum, v))
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			violations = append(violations, fmt.Sprintf("%v: expected at most %v got %v", path, *s.Maximum, v))
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			violations = append(violations, fmt.Sprintf("%v: expected at least %v characters got %v", path, *s.MinLength, n))
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			violations = append(violations, fmt.Sprintf("%v: expected at most %v characters got %v", path, *s.MaxLength, n))
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			violations = append(violations, fmt.Sprintf("%v: expected at least %v items got %v", path, *s.MinItems, len(v)))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			violations = append(violations, fmt.Sprintf("%v: expected at most %v items got %v", path, *s.MaxItems, len(v)))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				violations = s.Items.validate(item, fmt.Sprintf("%v[%v]", path, i), violations)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				violations = append(violations, fmt.Sprintf("%v: missing required property %v", path, name))
+			}
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if value, ok := v[name]; ok {
+				violations = s.Properties[name].validate(value, propertyPath(path, name), violations)
+			}
+		}
+	}
+	return violations
+}
+
+// keySchemasFor returns the schemas whose prefix the key starts with
+func keySchemasFor(tx *gorm.DB, userID uint, bucket string, key string) ([]KeySchema, error) {
+	var keySchemas []KeySchema
+	if err := tx.Where("user_id = ? AND bucket = ?", userID, bucket).Order("prefix").Find(&keySchemas).Error; err != nil {
+		return nil, err
+	}
+	matched := keySchemas[:0]
+	for _, keySchema := range keySchemas {
+		if strings.HasPrefix(key, keySchema.Prefix) {
+			matched = append(matched, keySchema)
+		}
+	}
+	return matched, nil
+}
+
+// checkKeySchemas returns a 422 listing the violations if a value doesn't match
+// every schema whose prefix the key starts with
+func checkKeySchemas(tx *gorm.DB, userID uint, bucket string, key string, value string) error {
+	keySchemas, err := keySchemasFor(tx, userID, bucket, key)
+	if err != nil {
+		return err
+	}
+
+	var violations []string
+	var doc interface{}
+	parsed := false
+	for _, keySchema := range keySchemas {
+		if !parsed {
+			var err error
+			if doc, err = decodeJSON([]byte(value)); err != nil {
+				return newSchemaError([]string{"$: expected valid JSON"})
+			}
+			parsed = true
+		}
+		schema, err := parseSchema([]byte(keySchema.Schema))
+		if err != nil {
+			return err
+		}
+		violations = schema.validate(doc, "$", violations)
+	}
+	if len(violations) == 0 {
+		return nil
+	} else if len(violations) > maxSchemaViolations {
+		violations = violations[:maxSchemaViolations]
+	}
+	return newSchemaError(violations)
+}
+
+// checkKeySchemaType returns a 422 if a hash, list or sorted set would be created under
+// a prefix that has a schema, as schemas only describe string values
+func checkKeySchemaType(tx *gorm.DB, userID uint, bucket string, key string) error {
+	keySchemas, err := keySchemasFor(tx, userID, bucket, key)
+	if err != nil {
+		return err
+	} else if len(keySchemas) > 0 {
+		return newSchemaError([]string{"$: expected a string key"})
+	}
+	return nil
+}
+
+func newSchemaError(violations []string) *requestError {
+	return &requestError{status: http.StatusUnprocessableEntity, message: "value does not match its schema", violations: violations}
+}
+
+type KeySchemaRequest struct {
+	Bucket string          `json:"bucket"`
+	Prefix string          `json:"prefix"` // "" matches every key in the bucket
+	Schema json.RawMessage `json:"schema"`
+}
+
+type KeySchemaListResponse struct {
+	Schemas []KeySchemaRequest `json:"schemas"`
+}
+
+type KeySchemaToDelete struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+}
+
+// setKeySchema adds or replaces the schema for a prefix. Keys that were written
+// before are left as they are and are only checked the next time they're written
+func setKeySchema(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("setKeySchema", err, w)
+			return
+		}
+
+		var sr KeySchemaRequest
+		err = json.NewDecoder(r.Body).Decode(&sr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if len(sr.Schema) == 0 {
+			APIUserError(w, "expected schema to be non-empty")
+			return
+		}
+		if len(sr.Schema) > maxSchemaSize {
+			APIUserError(w, fmt.Sprintf("expected schema to be at most %v bytes", maxSchemaSize))
+			return
+		}
+		if _, err = parseSchema(sr.Schema); err != nil {
+			APIUserError(w, err.Error())
+			return
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if _, err := getBucket(tx, user.ID, sr.Bucket); err != nil {
+				return err
+			}
+			var keySchema KeySchema
+			err := tx.Where("user_id = ? AND bucket = ? AND prefix = ?", user.ID, sr.Bucket, sr.Prefix).First(&keySchema).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return tx.Create(&KeySchema{UserID: int(user.ID), Bucket: sr.Bucket, Prefix: sr.Prefix, Schema: string(sr.Schema)}).Error
+			} else if err != nil {
+				return err
+			}
+			return tx.Model(&keySchema).Update("schema", string(sr.Schema)).Error
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError("setKeySchema", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&sr)
+	}
+}
+
+func listKeySchemas(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("listKeySchemas", err, w)
+			return
+		}
+
+		var keySchemas []KeySchema
+		if err = db.Where("user_id = ?", user.ID).Order("bucket, prefix").Find(&keySchemas).Error; err != nil {
+			APIServerError("listKeySchemas", err, w)
+			return
+		}
+
+		res := KeySchemaListResponse{Schemas: []KeySchemaRequest{}}
+		for _, keySchema := range keySchemas {
+			res.Schemas = append(res.Schemas, KeySchemaRequest{Bucket: keySchema.Bucket, Prefix: keySchema.Prefix, Schema: json.RawMessage(keySchema.Schema)})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+func deleteKeySchema(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("deleteKeySchema", err, w)
+			return
+		}
+
+		var sd KeySchemaToDelete
+		err = json.NewDecoder(r.Body).Decode(&sd)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+
+		result := db.Unscoped().Where("user_id = ? AND bucket = ? AND prefix = ?", user.ID, sd.Bucket, sd.Prefix).Delete(&KeySchema{})
+		if result.Error != nil {
+			APIServerError("deleteKeySchema", result.Error, w)
+			return
+		} else if result.RowsAffected == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// deleteBucketKeySchemas is for when a bucket is deleted
+func deleteBucketKeySchemas(tx *gorm.DB, userID uint, bucket string) error {
+	return tx.Unscoped().Where("user_id = ? AND bucket = ?", userID, bucket).Delete(&KeySchema{}).Error
+}
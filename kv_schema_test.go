@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["name", "port"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"port": {"type": "integer", "minimum": 1, "maximum": 65535},
+		"env": {"enum": ["dev", "prod"]},
+		"hosts": {"type": "array", "maxItems": 2, "items": {"type": "string"}}
+	}
+}`
+
+func TestSetKeySchema(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	// Setting the same prefix twice replaces the schema
+	for _, schema := range []string{`{"type": "string"}`, testSchema} {
+		req := httptest.NewRequest(http.MethodGet, "/schema/set", ioutil.NopCloser(strings.NewReader(`{"prefix": "config:", "schema": `+schema+`}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKeySchema(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/schema/list", nil)
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	listKeySchemas(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	var sl KeySchemaListResponse
+	if err := json.NewDecoder(res.Body).Decode(&sl); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	var expected bytes.Buffer
+	json.Compact(&expected, []byte(testSchema))
+	if len(sl.Schemas) != 1 || sl.Schemas[0].Prefix != "config:" || string(sl.Schemas[0].Schema) != expected.String() {
+		t.Errorf("expected the second schema for config: got %v", sl.Schemas)
+	}
+}
+
+func TestSetKeySchemaBadSchema(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for _, schema := range []string{
+		`{"type": "text"}`,
+		`{"pattern": "^a"}`,
+		`{"properties": {"a": {"minimum": "1"}}}`,
+		`{"minLength": -1}`,
+		`[]`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/schema/set", ioutil.NopCloser(strings.NewReader(`{"schema": `+schema+`}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKeySchema(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("expected 400 for %v got %v", schema, res.StatusCode)
+		}
+	}
+}
+
+func TestSetKeyWithSchema(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KeySchema{Prefix: "config:", Schema: testSchema, UserID: int(user.ID)})
+
+	for _, step := range []struct {
+		key        string
+		value      string
+		violations []string
+	}{
+		{"config:a", `{"name": "api", "port": 8080, "env": "prod", "hosts": ["a"]}`, nil},
+		{"other", "not json", nil},
+		{"config:b", "not json", []string{"$: expected valid JSON"}},
+		{"config:c", `[]`, []string{"$: expected object got array"}},
+		{"config:d", `{"name": "", "port": 80.5, "env": "test", "hosts": ["a", 1, "c"]}`, []string{
+			"$.env: expected one of \"dev\", \"prod\"",
+			"$.hosts: expected at most 2 items got 3",
+			"$.hosts[1]: expected string got integer",
+			"$.name: expected at least 1 characters got 0",
+			"$.port: expected integer got number",
+		}},
+		{"config:e", `{"port": 0}`, []string{"$: missing required property name", "$.port: expected at least 1 got 0"}},
+	} {
+		value, _ := json.Marshal(step.value)
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "`+step.key+`", "value": `+string(value)+`}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if step.violations == nil {
+			if res.StatusCode != 200 {
+				t.Errorf("expected 200 for %v got %v", step.key, res.StatusCode)
+			}
+			continue
+		}
+		if res.StatusCode != 422 {
+			t.Errorf("expected 422 for %v got %v", step.key, res.StatusCode)
+		}
+		var ue UserError
+		if err := json.NewDecoder(res.Body).Decode(&ue); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if strings.Join(ue.Violations, "\n") != strings.Join(step.violations, "\n") {
+			t.Errorf("expected violations %v for %v got %v", step.violations, step.key, ue.Violations)
+		}
+	}
+
+	// Check rejected values weren't written
+	var count int64
+	db.Model(&KVItem{}).Count(&count)
+	if count != 2 {
+		t.Errorf("expected 2 keys got %v", count)
+	}
+}
+
+func TestPatchKeyWithSchema(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KeySchema{Prefix: "config:", Schema: testSchema, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "config:a", Value: `{"name": "api", "port": 8080}`, TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/patch", ioutil.NopCloser(strings.NewReader(`{"key": "config:a", "mergePatch": {"port": null}}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	patchKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 422 {
+		t.Errorf("expected 422 got %v", res.StatusCode)
+	}
+}
+
+func TestIncrKeyWithSchema(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KeySchema{Prefix: "counter:", Schema: `{"type": "integer", "maximum": 5}`, UserID: int(user.ID)})
+
+	// Creating the key and incrementing it are both checked
+	for _, tc := range []struct {
+		body     string
+		expected int
+	}{
+		{`{"key": "counter:a", "delta": 6}`, 422},
+		{`{"key": "counter:a", "delta": 5}`, 200},
+		{`{"key": "counter:a", "delta": 1}`, 422},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/incr", ioutil.NopCloser(strings.NewReader(tc.body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		incrKey(db, 1)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != tc.expected {
+			t.Errorf("expected %v for %v got %v", tc.expected, tc.body, res.StatusCode)
+		}
+	}
+
+	kvItem := &KVItem{}
+	db.First(kvItem)
+	if kvItem.Value != "5" {
+		t.Errorf("expected 5 got %v", kvItem.Value)
+	}
+}
+
+func TestTypedKeyWithSchema(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KeySchema{Prefix: "config:", Schema: testSchema, UserID: int(user.ID)})
+
+	for _, handler := range []func(http.ResponseWriter, *http.Request){
+		hashSet(db),
+		listPush(db, false),
+		zsetAdd(db),
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/hset", ioutil.NopCloser(strings.NewReader(
+			`{"key": "config:a", "fields": {"a": "1"}, "values": ["a"], "members": [{"member": "a", "score": 1}]}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 422 {
+			t.Errorf("expected 422 got %v", res.StatusCode)
+		}
+	}
+
+	// Keys outside the prefix are unaffected
+	req := httptest.NewRequest(http.MethodGet, "/kv/hset", ioutil.NopCloser(strings.NewReader(`{"key": "some_hash", "fields": {"a": "1"}}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	hashSet(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	var count int64
+	db.Model(&KVItem{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected 1 key got %v", count)
+	}
+}
+
+func TestTypedKeyBeforeSchema(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "config:a", Type: typeHash, TTL: -1, Version: 1, UserID: int(user.ID)}
+	db.Create(kvItem)
+	db.Create(&KVHashField{KVItemID: kvItem.ID, Field: "a", Value: "1"})
+	db.Create(&KeySchema{Prefix: "config:", Schema: testSchema, UserID: int(user.ID)})
+
+	// The hash can't be added to once its prefix has a schema, but it can be emptied
+	for _, tc := range []struct {
+		handler  func(http.ResponseWriter, *http.Request)
+		body     string
+		expected int
+	}{
+		{hashSet(db), `{"key": "config:a", "fields": {"b": "2"}}`, 422},
+		{hashDelete(db), `{"key": "config:a", "fields": ["a"]}`, 200},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/hset", ioutil.NopCloser(strings.NewReader(tc.body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		tc.handler(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != tc.expected {
+			t.Errorf("expected %v for %v got %v", tc.expected, tc.body, res.StatusCode)
+		}
+	}
+}
+
+func TestRestoreTrashWithSchema(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	for _, kvItem := range []*KVItem{
+		{Key: "config:a", Value: `{"name": "api", "port": 8080}`, TTL: -1, Version: 1, UserID: int(user.ID)},
+		{Key: "config:b", Value: `{"name": "api"}`, TTL: -1, Version: 1, UserID: int(user.ID)},
+		{Key: "config:c", Type: typeHash, TTL: -1, Version: 1, UserID: int(user.ID)},
+	} {
+		db.Create(kvItem)
+		db.Delete(kvItem)
+	}
+	db.Create(&KeySchema{Prefix: "config:", Schema: testSchema, UserID: int(user.ID)})
+
+	// Only the key that matches the schema set since it was trashed can be restored
+	for _, tc := range []struct {
+		key      string
+		expected int
+	}{
+		{"config:a", 200},
+		{"config:b", 409},
+		{"config:c", 409},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/trash/restore", ioutil.NopCloser(strings.NewReader(`{"key": "`+tc.key+`"}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		restoreTrash(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != tc.expected {
+			t.Errorf("expected %v for %v got %v", tc.expected, tc.key, res.StatusCode)
+		}
+	}
+
+	var count int64
+	db.Model(&KVItem{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected 1 key to be live got %v", count)
+	}
+}
+
+func TestDeleteKeySchema(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KeySchema{Prefix: "config:", Schema: testSchema, UserID: int(user.ID)})
+
+	// The second delete finds nothing
+	for _, expected := range []int{200, 404} {
+		req := httptest.NewRequest(http.MethodGet, "/schema/delete", ioutil.NopCloser(strings.NewReader(`{"prefix": "config:"}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		deleteKeySchema(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != expected {
+			t.Errorf("expected %v got %v", expected, res.StatusCode)
+		}
+	}
+}
+
+func TestSetKeySchemaBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/schema/set", ioutil.NopCloser(strings.NewReader(`{"schema": {}}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	setKeySchema(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
@@ -7,6 +7,10 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 func TestSetKey(t *testing.T) {
@@ -200,3 +204,961 @@ func TestGetKeyMissing(t *testing.T) {
 		t.Errorf("expected 404 got %v", res.StatusCode)
 	}
 }
+
+func TestDeleteKey(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/delete", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	deleteKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	// Check the KVItem was removed and not just soft-deleted
+	var count int64
+	db.Unscoped().Model(&KVItem{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected no items got %v", count)
+	}
+}
+
+func TestDeleteKeyTrash(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/delete", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "trash": true}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	deleteKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	// Check the KVItem was soft-deleted so it's in the trash
+	var count int64
+	db.Model(&KVItem{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected no items got %v", count)
+	}
+	db.Unscoped().Model(&KVItem{}).Where("deleted_at IS NOT NULL").Count(&count)
+	if count != 1 {
+		t.Errorf("expected one item in the trash got %v", count)
+	}
+}
+
+func TestDeleteKeyBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/delete", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	deleteKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestDeleteKeyMissing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "other_key", Value: "some_value", TTL: -1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/delete", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	deleteKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+
+	// Check the other key was left alone
+	var count int64
+	db.Model(&KVItem{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected one item got %v", count)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "app:b", Value: "2", TTL: -1, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "app:a", Value: "1", TTL: 1986589728969, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "app:c", Value: "3", TTL: 1, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "apq", Value: "4", TTL: -1, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "app:d", Value: "5", TTL: -1, UserID: int(user.ID) + 1})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/list", ioutil.NopCloser(strings.NewReader(`{"prefix": "app:", "values": true}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	listKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	var lr KeyListResponse
+	if err := json.NewDecoder(res.Body).Decode(&lr); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	// Check only live keys with the prefix are returned, in order
+	if len(lr.Items) != 2 || lr.Cursor != "" {
+		t.Fatalf("expected two items and no cursor got %v %v", lr.Items, lr.Cursor)
+	}
+	if lr.Items[0].Key != "app:a" || *lr.Items[0].Value != "1" || lr.Items[0].TTL != 1986589728969 {
+		t.Errorf("expected first item to be app:a got %v %v %v", lr.Items[0].Key, *lr.Items[0].Value, lr.Items[0].TTL)
+	}
+	if lr.Items[1].Key != "app:b" || *lr.Items[1].Value != "2" || lr.Items[1].TTL != -1 {
+		t.Errorf("expected second item to be app:b got %v %v %v", lr.Items[1].Key, *lr.Items[1].Value, lr.Items[1].TTL)
+	}
+}
+
+func TestListKeysPagination(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	for _, key := range []string{"a", "b", "c"} {
+		db.Create(&KVItem{Key: key, Value: "v", TTL: -1, UserID: int(user.ID)})
+	}
+
+	list := func(body string) KeyListResponse {
+		req := httptest.NewRequest(http.MethodGet, "/kv/list", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		listKeys(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var lr KeyListResponse
+		if err := json.NewDecoder(res.Body).Decode(&lr); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		return lr
+	}
+
+	first := list(`{"limit": 2}`)
+	if len(first.Items) != 2 || first.Items[0].Key != "a" || first.Items[1].Key != "b" || first.Cursor == "" {
+		t.Fatalf("expected first page to be a, b with a cursor got %v %v", first.Items, first.Cursor)
+	}
+	if first.Items[0].Value != nil {
+		t.Errorf("expected values to be omitted got %v", *first.Items[0].Value)
+	}
+
+	second := list(`{"limit": 2, "cursor": "` + first.Cursor + `"}`)
+	if len(second.Items) != 1 || second.Items[0].Key != "c" || second.Cursor != "" {
+		t.Errorf("expected second page to be c with no cursor got %v %v", second.Items, second.Cursor)
+	}
+}
+
+func TestListKeysBadLimit(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/list", ioutil.NopCloser(strings.NewReader(`{"limit": 0}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	listKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("expected 400 got %v", res.StatusCode)
+	}
+}
+
+func TestListKeysBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/list", ioutil.NopCloser(strings.NewReader(`{}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	listKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestSetKeyIfVersion(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 2, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "value": "some_value2", "ifVersion": 2}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	// Check the new version is returned
+	var kv KeyVersion
+	if err := json.NewDecoder(res.Body).Decode(&kv); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if kv.Key != "some_key" || kv.Version != 3 {
+		t.Errorf("expected version 3 got %v %v", kv.Key, kv.Version)
+	}
+
+	var kvItem KVItem
+	db.First(&kvItem)
+	if kvItem.Value != "some_value2" || kvItem.Version != 3 {
+		t.Errorf("expected item to be updated got %v %v", kvItem.Value, kvItem.Version)
+	}
+}
+
+func TestSetKeyIfVersionConflict(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 2, UserID: int(user.ID)})
+
+	for _, body := range []string{
+		`{"key": "some_key", "value": "some_value2", "ifVersion": 1}`,
+		`{"key": "other_key", "value": "some_value2", "ifVersion": 1}`,
+		`{"key": "some_key", "value": "some_value2", "ifAbsent": true}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 409 {
+			t.Errorf("expected 409 for %v got %v", body, res.StatusCode)
+		}
+	}
+
+	// Check nothing was written
+	var kvItems []KVItem
+	db.Find(&kvItems)
+	if len(kvItems) != 1 || kvItems[0].Value != "some_value" || kvItems[0].Version != 2 {
+		t.Errorf("expected item to be unchanged got %v", kvItems)
+	}
+}
+
+func TestSetKeyIfAbsent(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "expired_key", Value: "some_value", TTL: 1, Version: 4, UserID: int(user.ID)})
+
+	for _, key := range []string{"some_key", "expired_key"} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "`+key+`", "value": "new_value", "ifAbsent": true}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 for %v got %v", key, res.StatusCode)
+		}
+	}
+
+	var kvItems []KVItem
+	db.Order("key").Find(&kvItems)
+	if len(kvItems) != 2 {
+		t.Fatalf("expected two items got %v", len(kvItems))
+	}
+	if kvItems[0].Key != "expired_key" || kvItems[0].Value != "new_value" || kvItems[0].TTL != -1 || kvItems[0].Version != 5 {
+		t.Errorf("expected expired key to be overwritten got %v %v %v", kvItems[0].Value, kvItems[0].TTL, kvItems[0].Version)
+	}
+	if kvItems[1].Key != "some_key" || kvItems[1].Value != "new_value" || kvItems[1].Version != 1 {
+		t.Errorf("expected new key to be created got %v %v %v", kvItems[1].Key, kvItems[1].Value, kvItems[1].Version)
+	}
+}
+
+func TestSetKeyModeNX(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 2, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "expired_key", Value: "some_value", TTL: 1, Version: 4, UserID: int(user.ID)})
+
+	for key, expected := range map[string]SetKeyResponse{
+		"some_key":    {Key: "some_key", Version: 2, Written: false},
+		"expired_key": {Key: "expired_key", Version: 5, Written: true},
+		"other_key":   {Key: "other_key", Version: 1, Written: true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "`+key+`", "value": "new_value", "mode": "nx"}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 for %v got %v", key, res.StatusCode)
+		}
+		var sr SetKeyResponse
+		if err := json.NewDecoder(res.Body).Decode(&sr); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if sr != expected {
+			t.Errorf("expected %v got %v", expected, sr)
+		}
+	}
+
+	// Check the existing key wasn't overwritten
+	var kvItem KVItem
+	db.Where("key = ?", "some_key").First(&kvItem)
+	if kvItem.Value != "some_value" || kvItem.Version != 2 {
+		t.Errorf("expected item to be unchanged got %v %v", kvItem.Value, kvItem.Version)
+	}
+}
+
+func TestSetKeyModeXX(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 2, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "expired_key", Value: "some_value", TTL: 1, Version: 4, UserID: int(user.ID)})
+
+	for key, expected := range map[string]SetKeyResponse{
+		"some_key":    {Key: "some_key", Version: 3, Written: true},
+		"expired_key": {Key: "expired_key", Version: 0, Written: false},
+		"other_key":   {Key: "other_key", Version: 0, Written: false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "`+key+`", "value": "new_value", "mode": "xx"}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 for %v got %v", key, res.StatusCode)
+		}
+		var sr SetKeyResponse
+		if err := json.NewDecoder(res.Body).Decode(&sr); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if sr != expected {
+			t.Errorf("expected %v got %v", expected, sr)
+		}
+	}
+
+	// Check a missing key wasn't created
+	var kvItems []KVItem
+	db.Order("key").Find(&kvItems)
+	if len(kvItems) != 2 || kvItems[0].Value != "some_value" || kvItems[1].Value != "new_value" {
+		t.Errorf("expected only some_key to be updated got %v", kvItems)
+	}
+}
+
+func TestSetKeyBadMode(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for _, body := range []string{
+		`{"key": "some_key", "value": "some_value", "mode": "yy"}`,
+		`{"key": "some_key", "value": "some_value", "mode": "nx", "ifAbsent": true}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("expected 400 for %v got %v", body, res.StatusCode)
+		}
+	}
+}
+
+func TestGetKeyVersion(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 7, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/get", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	getKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	var kv KeyValue
+	if err := json.NewDecoder(res.Body).Decode(&kv); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if kv.Version != 7 {
+		t.Errorf("expected version 7 got %v", kv.Version)
+	}
+}
+
+func TestIncrKey(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "10", TTL: 1986589728969, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/incr", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "delta": 5}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	incrKey(db, 1)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var ir IncrResponse
+	if err := json.NewDecoder(res.Body).Decode(&ir); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if ir.Value != 15 || ir.Version != 2 {
+		t.Errorf("expected value 15 and version 2 got %v %v", ir.Value, ir.Version)
+	}
+
+	// Check the TTL was kept
+	var kvItem KVItem
+	db.First(&kvItem)
+	if kvItem.Value != "15" || kvItem.TTL != 1986589728969 {
+		t.Errorf("expected item to be updated got %v %v", kvItem.Value, kvItem.TTL)
+	}
+}
+
+func TestDecrKeyMissing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "expired_key", Value: "10", TTL: 1, Version: 1, UserID: int(user.ID)})
+
+	for _, key := range []string{"some_key", "expired_key"} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/decr", ioutil.NopCloser(strings.NewReader(`{"key": "`+key+`"}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		incrKey(db, -1)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var ir IncrResponse
+		if err := json.NewDecoder(res.Body).Decode(&ir); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if ir.Value != -1 {
+			t.Errorf("expected %v to start from zero got %v", key, ir.Value)
+		}
+	}
+
+	var kvItem KVItem
+	db.Where("key = ?", "expired_key").First(&kvItem)
+	if kvItem.Value != "-1" || kvItem.TTL != -1 {
+		t.Errorf("expected expired key to be reset got %v %v", kvItem.Value, kvItem.TTL)
+	}
+}
+
+func TestIncrKeyNotInteger(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/incr", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	incrKey(db, 1)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+}
+
+func TestIncrKeyBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/incr", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	incrKey(db, 1)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestMultiGetKeys(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "a", Value: "1", TTL: -1, Version: 1, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "b", Value: "2", TTL: -1, Version: 3, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "c", Value: "3", TTL: 1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/mget", ioutil.NopCloser(strings.NewReader(`{"keys": ["b", "c", "a", "d"]}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	multiGetKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var mg MultiGetResponse
+	if err := json.NewDecoder(res.Body).Decode(&mg); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	// Check found keys keep the requested order and expired keys are missing
+	if len(mg.Found) != 2 || mg.Found[0].Key != "b" || mg.Found[0].Value != "2" || mg.Found[0].Version != 3 || mg.Found[1].Key != "a" {
+		t.Errorf("expected to find b and a got %v", mg.Found)
+	}
+	if len(mg.Missing) != 2 || mg.Missing[0] != "c" || mg.Missing[1] != "d" {
+		t.Errorf("expected c and d to be missing got %v", mg.Missing)
+	}
+}
+
+func TestMultiGetKeysBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/mget", ioutil.NopCloser(strings.NewReader(`{"keys": ["a"]}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	multiGetKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestMultiSetKeys(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "b", Value: "old", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/mset", ioutil.NopCloser(strings.NewReader(`{"items": [{"key": "a", "value": "1"}, {"key": "b", "value": "2", "ttl": 1986589728969}]}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	multiSetKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var ms MultiSetResponse
+	if err := json.NewDecoder(res.Body).Decode(&ms); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if len(ms.Items) != 2 || ms.Items[0].Key != "a" || ms.Items[0].Version != 1 || ms.Items[1].Key != "b" || ms.Items[1].Version != 2 {
+		t.Errorf("expected versions for a and b got %v", ms.Items)
+	}
+
+	var kvItems []KVItem
+	db.Order("key").Find(&kvItems)
+	if len(kvItems) != 2 {
+		t.Fatalf("expected two items got %v", len(kvItems))
+	}
+	if kvItems[0].Value != "1" || kvItems[0].TTL != -1 || kvItems[1].Value != "2" || kvItems[1].TTL != 1986589728969 {
+		t.Errorf("expected items to be written got %v", kvItems)
+	}
+}
+
+func TestMultiSetKeysMode(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "b", Value: "old", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/mset", ioutil.NopCloser(strings.NewReader(`{"items": [{"key": "a", "value": "1", "mode": "nx"}, {"key": "b", "value": "2", "mode": "nx"}]}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	multiSetKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var ms MultiSetResponse
+	if err := json.NewDecoder(res.Body).Decode(&ms); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if len(ms.Items) != 2 || ms.Items[0] != (SetKeyResponse{Key: "a", Version: 1, Written: true}) || ms.Items[1] != (SetKeyResponse{Key: "b", Version: 1, Written: false}) {
+		t.Errorf("expected a to be written and b to be skipped got %v", ms.Items)
+	}
+
+	var kvItems []KVItem
+	db.Order("key").Find(&kvItems)
+	if len(kvItems) != 2 || kvItems[0].Value != "1" || kvItems[1].Value != "old" {
+		t.Errorf("expected only a to be written got %v", kvItems)
+	}
+}
+
+func TestMultiSetKeysAllOrNothing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "b", Value: "old", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/mset", ioutil.NopCloser(strings.NewReader(`{"items": [{"key": "a", "value": "1"}, {"key": "b", "value": "2", "ifAbsent": true}]}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	multiSetKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+
+	// Check the first item was rolled back
+	var kvItems []KVItem
+	db.Find(&kvItems)
+	if len(kvItems) != 1 || kvItems[0].Value != "old" {
+		t.Errorf("expected only the original item got %v", kvItems)
+	}
+}
+
+func TestUpsertKeyConflict(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	existing := &KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 3, UserID: int(user.ID)}
+	db.Create(existing)
+
+	// Leaving the key alone returns it as it is
+	ki := KVItem{Key: "some_key", Value: "some_value2", TTL: -1, Version: 1, UserID: int(user.ID)}
+	written, err := upsertKey(db, &ki, false)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if written || ki.ID != existing.ID || ki.Value != "some_value" || ki.Version != 3 {
+		t.Errorf("expected the existing key got %v %v", written, ki)
+	}
+
+	// Overwriting the key bumps its version rather than creating another
+	ki = KVItem{Key: "some_key", Value: "some_value2", TTL: -1, Version: 1, UserID: int(user.ID)}
+	written, err = upsertKey(db, &ki, true)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if !written || ki.ID != existing.ID || ki.Value != "some_value2" || ki.Version != 4 {
+		t.Errorf("expected the key to be overwritten got %v %v", written, ki)
+	}
+	var count int64
+	db.Model(&KVItem{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected one item got %v", count)
+	}
+}
+
+// createConcurrently creates kvItem just before the next key is created, as if by another
+// request that read the key as missing at the same time
+func createConcurrently(db *gorm.DB, kvItem *KVItem) {
+	created := false
+	db.Callback().Create().Before("gorm:create").Register("test:create_concurrently", func(tx *gorm.DB) {
+		if ki, ok := tx.Statement.Dest.(*KVItem); ok && ki != kvItem && !created {
+			created = true
+			tx.Session(&gorm.Session{NewDB: true}).Create(kvItem)
+		}
+	})
+}
+
+func TestIncrKeyCreatedConcurrently(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	createConcurrently(db, &KVItem{Key: "some_key", Value: "10", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/incr", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "delta": 5}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	incrKey(db, 1)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var ir IncrResponse
+	if err := json.NewDecoder(res.Body).Decode(&ir); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if ir.Value != 15 || ir.Version != 2 {
+		t.Errorf("expected the other writer's key to be incremented got %v %v", ir.Value, ir.Version)
+	}
+}
+
+// updateConcurrently bumps a key's version just before the next times updates, as if by
+// another request that wrote the key after it was read
+func updateConcurrently(db *gorm.DB, id uint, times int) {
+	db.Callback().Update().Before("gorm:update").Register("test:update_concurrently", func(tx *gorm.DB) {
+		if tx.Statement.Table == "kv_items" && times > 0 {
+			times--
+			tx.Session(&gorm.Session{NewDB: true}).Exec("UPDATE kv_items SET version = version + 1 WHERE id = ?", id)
+		}
+	})
+}
+
+func TestSetKeyUpdatedConcurrently(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 1, UserID: int(user.ID)}
+	db.Create(kvItem)
+	updateConcurrently(db, kvItem.ID, 1)
+
+	// A set without ifVersion is retried so the last write wins
+	req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "value": "some_value2"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	db.First(kvItem)
+	if kvItem.Value != "some_value2" || kvItem.Version != 2 {
+		t.Errorf("expected the set to be written got %v %v", kvItem.Value, kvItem.Version)
+	}
+}
+
+func TestSetKeyIfVersionUpdatedConcurrently(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 1, UserID: int(user.ID)}
+	db.Create(kvItem)
+	updateConcurrently(db, kvItem.ID, 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "value": "some_value2", "ifVersion": 1}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+
+	db.First(kvItem)
+	if kvItem.Value != "some_value" {
+		t.Errorf("expected the key to be unchanged got %v", kvItem.Value)
+	}
+}
+
+func TestIncrKeyUpdatedConcurrently(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_key", Value: "10", TTL: -1, Version: 1, UserID: int(user.ID)}
+	db.Create(kvItem)
+	updateConcurrently(db, kvItem.ID, 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/incr", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "delta": 5}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	incrKey(db, 1)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var ir IncrResponse
+	if err := json.NewDecoder(res.Body).Decode(&ir); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if ir.Value != 15 || ir.Version != 2 {
+		t.Errorf("expected the increment to be retried got %v %v", ir.Value, ir.Version)
+	}
+}
+
+func TestSetKeyAfterDelete(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	// A soft-deleted key doesn't count towards the unique index, but its version is carried on from
+	deleted := &KVItem{Key: "some_key", Value: "some_value", TTL: 1, Version: 3, UserID: int(user.ID)}
+	db.Create(deleted)
+	db.Delete(deleted)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "value": "some_value2"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var sk SetKeyResponse
+	if err := json.NewDecoder(res.Body).Decode(&sk); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if sk.Version != 4 {
+		t.Errorf("expected version 4 got %v", sk.Version)
+	}
+}
+
+func TestKeyVersionsAfterRemoval(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	// Each key is removed at version 2 and created again, by the same endpoint or another
+	for _, tc := range []struct {
+		create  func(db *gorm.DB) func(http.ResponseWriter, *http.Request)
+		body    string
+		expired bool
+	}{
+		{setKey, `{"key": "some_key", "value": "some_value"}`, false},
+		{func(db *gorm.DB) func(http.ResponseWriter, *http.Request) { return incrKey(db, 1) }, `{"key": "some_key"}`, false},
+		{hashSet, `{"key": "some_key", "fields": {"a": "1"}}`, true},
+	} {
+		kvItem := &KVItem{Key: "some_key", Value: "1", TTL: -1, Version: 2, UserID: int(user.ID)}
+		if tc.expired {
+			kvItem.TTL = 1
+		}
+		db.Create(kvItem)
+		if tc.expired {
+			if _, err := expireKeys(db, []uint{kvItem.ID}); err != nil {
+				t.Errorf("expected error to be nil got %v", err)
+			}
+		} else {
+			req := httptest.NewRequest(http.MethodGet, "/kv/delete", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+			req.Header.Set("Authorization", "Bearer "+user.Token)
+			deleteKey(db)(httptest.NewRecorder(), req)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(tc.body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		tc.create(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 for %v got %v", tc.body, res.StatusCode)
+		}
+		created := &KVItem{}
+		db.Where("key = ?", "some_key").First(created)
+		if created.Version != 3 {
+			t.Errorf("expected version 3 for %v got %v", tc.body, created.Version)
+		}
+		db.Unscoped().Where("key = ?", "some_key").Delete(&KVItem{})
+	}
+}
+
+func TestDedupKVItems(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	// Like a database from before keys had a unique index
+	db.Migrator().DropIndex(&KVItem{}, "idx_kv_user_bucket_key")
+	now := time.Now()
+	db.Create(&KVItem{Model: gorm.Model{UpdatedAt: now.Add(-time.Minute)}, Key: "some_key", Value: "older", TTL: -1, UserID: int(user.ID)})
+	db.Create(&KVItem{Model: gorm.Model{UpdatedAt: now}, Key: "some_key", Value: "newest", TTL: -1, UserID: int(user.ID)})
+	db.Create(&KVItem{Model: gorm.Model{UpdatedAt: now.Add(-time.Hour)}, Key: "some_key", Value: "oldest", TTL: -1, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "other_key", Value: "other", TTL: -1, UserID: int(user.ID)})
+
+	if err := dedupKVItems(db); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	var kvItems []KVItem
+	db.Order("key").Find(&kvItems)
+	if len(kvItems) != 2 || kvItems[0].Value != "other" || kvItems[1].Value != "newest" {
+		t.Errorf("expected the newest some_key and other_key to remain got %v", kvItems)
+	}
+}
+
+func TestMigrateBaselineKVItems(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+	// The kv_items table as it was before buckets, versions and the unique index
+	type baselineKVItem struct {
+		gorm.Model
+		Key    string
+		Value  string
+		TTL    int
+		UserID int
+	}
+	db.Table("kv_items").AutoMigrate(&baselineKVItem{})
+	now := time.Now()
+	db.Table("kv_items").Create(&baselineKVItem{Model: gorm.Model{UpdatedAt: now.Add(-time.Minute)}, Key: "some_key", Value: "older", TTL: -1, UserID: 1})
+	db.Table("kv_items").Create(&baselineKVItem{Model: gorm.Model{UpdatedAt: now}, Key: "some_key", Value: "newest", TTL: -1, UserID: 1})
+
+	if err = migrate(db); err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+	if !db.Migrator().HasIndex(&KVItem{}, "idx_kv_user_bucket_key") {
+		t.Errorf("expected the unique index to be created")
+	}
+
+	// Check the remaining key is in the default bucket at version 1
+	var kvItems []KVItem
+	db.Find(&kvItems)
+	if len(kvItems) != 1 || kvItems[0].Value != "newest" || kvItems[0].Bucket != "" || kvItems[0].Version != 1 {
+		t.Errorf("expected the newest some_key to remain got %v", kvItems)
+	}
+	var kvItem KVItem
+	if err = liveKey(db, 1, "", "some_key").First(&kvItem).Error; err != nil {
+		t.Errorf("expected the key to be found got %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// maxTrashRetentionMs is 90 days
+const maxTrashRetentionMs = 90 * 24 * 60 * 60 * 1000
+
+// trashPurgeInterval is how often the trash is checked for rows that are past their retention
+const trashPurgeInterval = 1 * time.Minute
+
+// trashPurgeBatchSize bounds how many rows are purged in one transaction
+const trashPurgeBatchSize = 500
+
+type TrashListRequest struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	Limit  int    `json:"limit"`
+}
+
+type TrashItem struct {
+	Bucket    string `json:"bucket,omitempty"`
+	Key       string `json:"key"`
+	Type      string `json:"type,omitempty"`
+	TTL       int    `json:"ttl"`
+	Version   int    `json:"version"`
+	DeletedAt int    `json:"deletedAt"` // UnixMilli
+}
+
+type TrashListResponse struct {
+	Items []TrashItem `json:"items"`
+}
+
+type TrashRestoreRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// trashedKeys scopes a query to a user's keys in a bucket that are in the trash
+func trashedKeys(tx *gorm.DB, userID uint, bucket string) *gorm.DB {
+	return tx.Unscoped().Where("user_id = ? AND bucket = ? AND deleted_at IS NOT NULL", userID, bucket)
+}
+
+// listTrash returns the keys that have been moved to the trash or have expired, most recently deleted first.
+// A key that's been deleted more than once is listed once for every time
+func listTrash(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("listTrash", err, w)
+			return
+		}
+
+		tr := &TrashListRequest{Limit: defaultListLimit}
+		err = json.NewDecoder(r.Body).Decode(&tr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if tr.Limit < 1 || tr.Limit > maxListLimit {
+			APIUserError(w, fmt.Sprintf("expected limit to be between 1 and %v", maxListLimit))
+			return
+		}
+
+		query := trashedKeys(db, user.ID, tr.Bucket)
+		if tr.Prefix != "" {
+			query = query.Where("key >= ?", tr.Prefix)
+			if end := prefixEnd(tr.Prefix); end != "" {
+				query = query.Where("key < ?", end)
+			}
+		}
+		var kvItems []KVItem
+		if err = query.Order("deleted_at desc, id desc").Limit(tr.Limit).Find(&kvItems).Error; err != nil {
+			APIServerError("listTrash", err, w)
+			return
+		}
+
+		res := TrashListResponse{Items: make([]TrashItem, 0, len(kvItems))}
+		for _, kvItem := range kvItems {
+			res.Items = append(res.Items, TrashItem{
+				Bucket:    kvItem.Bucket,
+				Key:       kvItem.Key,
+				Type:      kvItem.Type,
+				TTL:       kvItem.TTL,
+				Version:   kvItem.Version,
+				DeletedAt: int(kvItem.DeletedAt.Time.UnixMilli()),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// restoreTrash brings back the most recently deleted copy of a key along with its data.
+// The key's TTL is removed if it has passed, and its history starts again from the restored version
+func restoreTrash(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("restoreTrash", err, w)
+			return
+		}
+
+		var tr TrashRestoreRequest
+		err = json.NewDecoder(r.Body).Decode(&tr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if tr.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+
+		var kvItem KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := trashedKeys(tx, user.ID, tr.Bucket).Where("key = ?", tr.Key).Order("deleted_at desc, id desc").First(&kvItem).Error; err != nil {
+				return err
+			}
+			// Only one copy of a key can be live, including an expired one that hasn't been cleared up yet
+			var existing int64
+			if err := userKey(tx, user.ID, tr.Bucket, tr.Key).Model(&KVItem{}).Count(&existing).Error; err != nil {
+				return err
+			} else if existing > 0 {
+				return newConflictError("key already exists")
+			}
+			// Schemas may have been set since the key was trashed
+			err := checkKeySchemaType(tx, user.ID, tr.Bucket, tr.Key)
+			if kvItem.Type == typeString {
+				err = checkKeySchemas(tx, user.ID, tr.Bucket, tr.Key, kvItem.Value)
+			}
+			if rErr, ok := err.(*requestError); ok {
+				rErr.status = http.StatusConflict
+				return rErr
+			} else if err != nil {
+				return err
+			}
+
+			if kvItem.TTL != -1 && kvItem.TTL < int(time.Now().UnixMilli()) {
+				kvItem.TTL = -1
+			}
+			// The key may have been created and removed again since this copy was trashed
+			last, err := lastKeyVersion(tx, user.ID, tr.Bucket, tr.Key)
+			if err != nil {
+				return err
+			}
+			result := tx.Unscoped().Model(&KVItem{}).Where("id = ? AND version = ?", kvItem.ID, kvItem.Version).
+				Updates(map[string]interface{}{"deleted_at": nil, "ttl": kvItem.TTL, "version": last + 1})
+			if result.Error != nil {
+				return result.Error
+			} else if result.RowsAffected == 0 {
+				return newConflictError("key was restored concurrently")
+			}
+			kvItem.DeletedAt, kvItem.Version = gorm.DeletedAt{}, last+1
+			if err := keyEvent(tx, eventOpSet, &kvItem, 0); err != nil {
+				return err
+			}
+			return recordHistory(tx, user, &kvItem)
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("restoreTrash", err, w)
+			return
+		}
+		kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(&kvItem)})
+		kvExpiry.schedule(&kvItem)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		res := newKeyValue(&kvItem)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// trashPurger permanently removes soft-deleted keys and queue messages once they're
+// older than their user's retention
+type trashPurger struct {
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newTrashPurger() *trashPurger {
+	return &trashPurger{done: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+func (p *trashPurger) start(db *gorm.DB) {
+	go p.run(db)
+}
+
+// stop waits for the purge that's running, if there is one, to finish
+func (p *trashPurger) stop() {
+	close(p.done)
+	<-p.stopped
+}
+
+func (p *trashPurger) run(db *gorm.DB) {
+	defer close(p.stopped)
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := purgeTrash(db, p.done); err != nil {
+				log.Printf("trashPurger: error %v", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// purgeTrash purges every user's trash in batches, returning early if done is closed
+func purgeTrash(db *gorm.DB, done <-chan struct{}) error {
+	var users []User
+	if err := db.Select("id", "trash_retention_ms").Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		cutoff := time.Now().Add(-time.Duration(user.TrashRetentionMs) * time.Millisecond)
+		for _, model := range []interface{}{&KVItem{}, &QueueItem{}} {
+			for {
+				select {
+				case <-done:
+					return nil
+				default:
+				}
+				purged, err := purgeDeleted(db, model, user.ID, cutoff)
+				if err != nil {
+					return err
+				} else if purged < trashPurgeBatchSize {
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// purgeDeleted permanently removes a batch of a user's rows of model that were deleted before cutoff
+func purgeDeleted(db *gorm.DB, model interface{}, userID uint, cutoff time.Time) (int, error) {
+	var ids []uint
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(model).Where("user_id = ? AND deleted_at < ?", userID, cutoff).
+			Limit(trashPurgeBatchSize).Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		if _, ok := model.(*KVItem); ok {
+			if err = deleteKeyData(tx, ids); err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Delete(model, ids).Error
+	})
+	return len(ids), err
+}
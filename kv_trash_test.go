@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestListTrash(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	now := time.Now()
+	db.Create(&KVItem{Model: gorm.Model{DeletedAt: gorm.DeletedAt{Time: now.Add(-time.Minute), Valid: true}}, Key: "app:a", TTL: -1, Version: 2, UserID: int(user.ID)})
+	db.Create(&KVItem{Model: gorm.Model{DeletedAt: gorm.DeletedAt{Time: now, Valid: true}}, Key: "app:b", TTL: -1, Version: 3, UserID: int(user.ID)})
+	db.Create(&KVItem{Model: gorm.Model{DeletedAt: gorm.DeletedAt{Time: now, Valid: true}}, Key: "other:a", TTL: -1, Version: 1, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "app:c", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/trash/list", ioutil.NopCloser(strings.NewReader(`{"prefix": "app:"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	listTrash(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var tl TrashListResponse
+	if err := json.NewDecoder(res.Body).Decode(&tl); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	// Most recently deleted first, and live keys aren't in the trash
+	if len(tl.Items) != 2 || tl.Items[0].Key != "app:b" || tl.Items[1].Key != "app:a" {
+		t.Errorf("expected app:b and app:a got %v", tl.Items)
+	}
+	if tl.Items[0].Version != 3 || tl.Items[0].DeletedAt != int(now.UnixMilli()) {
+		t.Errorf("expected version and deletedAt to be returned got %v", tl.Items[0])
+	}
+}
+
+func TestRestoreTrash(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	// An expired hash that was cleared up, it keeps its fields in the trash
+	kvItem := &KVItem{Key: "some_hash", Type: typeHash, TTL: 1, Version: 2, UserID: int(user.ID)}
+	db.Create(kvItem)
+	db.Create(&KVHashField{KVItemID: kvItem.ID, Field: "a", Value: "1"})
+	db.Delete(kvItem)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/trash/restore", ioutil.NopCloser(strings.NewReader(`{"key": "some_hash"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	restoreTrash(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var kv KeyValue
+	if err := json.NewDecoder(res.Body).Decode(&kv); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if kv.Key != "some_hash" || kv.Type != typeHash || kv.TTL != -1 || kv.Version != 3 {
+		t.Errorf("expected the key to be restored without its TTL got %v", kv)
+	}
+
+	// Check the hash is live again with its fields
+	req = httptest.NewRequest(http.MethodGet, "/kv/hget", ioutil.NopCloser(strings.NewReader(`{"key": "some_hash", "field": "a"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w = httptest.NewRecorder()
+	hashGet(db)(w, req)
+
+	res = w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+}
+
+func TestRestoreTrashAfterRecreate(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	kvItem := &KVItem{Key: "some_key", Value: "old_value", TTL: -1, Version: 2, UserID: int(user.ID)}
+	db.Create(kvItem)
+	db.Delete(kvItem)
+	// The key was created again and deleted for good at a later version
+	db.Create(&KVTombstone{Key: "some_key", Version: 5, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/trash/restore", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	restoreTrash(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var kv KeyValue
+	if err := json.NewDecoder(res.Body).Decode(&kv); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if kv.Value != "old_value" || kv.Version != 6 {
+		t.Errorf("expected the key to be restored at version 6 got %v", kv)
+	}
+}
+
+func TestRestoreTrashExists(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	deleted := &KVItem{Key: "some_key", Value: "old_value", TTL: -1, Version: 2, UserID: int(user.ID)}
+	db.Create(deleted)
+	db.Delete(deleted)
+	db.Create(&KVItem{Key: "some_key", Value: "new_value", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/trash/restore", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	restoreTrash(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+}
+
+func TestRestoreTrashMissing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/trash/restore", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	restoreTrash(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
+
+func TestRestoreTrashBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/trash/restore", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	restoreTrash(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a", TrashRetentionMs: 60000}
+	db.Create(user)
+	now := time.Now()
+	old := &KVItem{Model: gorm.Model{DeletedAt: gorm.DeletedAt{Time: now.Add(-2 * time.Minute), Valid: true}}, Key: "old_key", Type: typeHash, TTL: -1, UserID: int(user.ID)}
+	db.Create(old)
+	db.Create(&KVHashField{KVItemID: old.ID, Field: "a", Value: "1"})
+	db.Create(&KVItem{Model: gorm.Model{DeletedAt: gorm.DeletedAt{Time: now, Valid: true}}, Key: "recent_key", TTL: -1, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "live_key", TTL: -1, UserID: int(user.ID)})
+	db.Create(&QueueItem{Model: gorm.Model{DeletedAt: gorm.DeletedAt{Time: now.Add(-2 * time.Minute), Valid: true}}, Namespace: "some_namespace", UserID: int(user.ID)})
+	db.Create(&QueueItem{Namespace: "some_namespace", UserID: int(user.ID)})
+
+	if err := purgeTrash(db, make(chan struct{})); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	// Check only rows deleted before the retention were purged
+	var kvItems []KVItem
+	db.Unscoped().Order("key").Find(&kvItems)
+	if len(kvItems) != 2 || kvItems[0].Key != "live_key" || kvItems[1].Key != "recent_key" {
+		t.Errorf("expected live_key and recent_key to remain got %v", kvItems)
+	}
+	var fields, queueItems int64
+	db.Model(&KVHashField{}).Count(&fields)
+	db.Unscoped().Model(&QueueItem{}).Count(&queueItems)
+	if fields != 0 || queueItems != 1 {
+		t.Errorf("expected the purged key's fields and the old message to be removed got %v %v", fields, queueItems)
+	}
+}
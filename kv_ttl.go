@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type TTLRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	TTL    *int   `json:"ttl"`   // UnixMilli
+	TTLMs  *int   `json:"ttlMs"` // relative to now
+}
+
+type KeyTTL struct {
+	Bucket      string `json:"bucket,omitempty"`
+	Key         string `json:"key"`
+	TTL         int    `json:"ttl"`
+	RemainingMs int    `json:"remainingMs"` // -1 is do not expire
+	Version     int    `json:"version"`
+}
+
+// resolveTTL returns the absolute TTL for a request that passed a relative ttlMs,
+// or a message describing why it's invalid. ttlSet is whether the request also passed ttl
+func resolveTTL(ttlSet bool, ttlMs *int) (int, string) {
+	if ttlSet {
+		return 0, "expected at most one of ttl and ttlMs"
+	} else if *ttlMs < 1 {
+		return 0, "expected ttlMs to be positive"
+	}
+	return int(time.Now().UnixMilli()) + *ttlMs, ""
+}
+
+func newKeyTTL(kvItem *KVItem) KeyTTL {
+	remaining := -1
+	if kvItem.TTL != -1 {
+		remaining = kvItem.TTL - int(time.Now().UnixMilli())
+		if remaining < 0 {
+			remaining = 0
+		}
+	}
+	return KeyTTL{Bucket: kvItem.Bucket, Key: kvItem.Key, TTL: kvItem.TTL, RemainingMs: remaining, Version: kvItem.Version}
+}
+
+// setKeyTTL changes a key's TTL without rewriting its value.
+// With persist the TTL is cleared, otherwise one of ttl or ttlMs is required
+func setKeyTTL(db *gorm.DB, persist bool) func(http.ResponseWriter, *http.Request) {
+	route := "expireKey"
+	if persist {
+		route = "persistKey"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError(route, err, w)
+			return
+		}
+
+		var tr TTLRequest
+		err = json.NewDecoder(r.Body).Decode(&tr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if tr.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+		ttl := -1
+		if !persist {
+			if (tr.TTL == nil) == (tr.TTLMs == nil) {
+				APIUserError(w, "expected exactly one of ttl and ttlMs")
+				return
+			} else if tr.TTL != nil {
+				ttl = *tr.TTL
+			} else {
+				var msg string
+				if ttl, msg = resolveTTL(false, tr.TTLMs); msg != "" {
+					APIUserError(w, msg)
+					return
+				}
+			}
+		}
+
+		var kvItem KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err = liveKey(tx, user.ID, tr.Bucket, tr.Key).First(&kvItem).Error; err != nil {
+				return err
+			}
+			result := tx.Model(&KVItem{}).Where("id = ? AND version = ?", kvItem.ID, kvItem.Version).
+				Updates(map[string]interface{}{"ttl": ttl, "version": kvItem.Version + 1})
+			if result.Error != nil {
+				return result.Error
+			} else if result.RowsAffected == 0 {
+				return newConflictError("key was modified concurrently")
+			}
+			kvItem.TTL, kvItem.Version = ttl, kvItem.Version+1
+			if err = keyEvent(tx, eventOpSet, &kvItem, kvItem.Version-1); err != nil {
+				return err
+			}
+			return recordHistory(tx, user, &kvItem)
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError(route, err, w)
+			return
+		}
+		kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(&kvItem)})
+		kvExpiry.schedule(&kvItem)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(newKeyTTL(&kvItem))
+	}
+}
+
+func getKeyTTL(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("getKeyTTL", err, w)
+			return
+		}
+
+		var k Key
+		err = json.NewDecoder(r.Body).Decode(&k)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if k.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+
+		var kvItem KVItem
+		err = liveKey(db, user.ID, k.Bucket, k.Key).First(&kvItem).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("getKeyTTL", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(newKeyTTL(&kvItem))
+	}
+}
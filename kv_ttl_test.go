@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetKeyTTLMs(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "value": "some_value", "ttlMs": 20000}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	// Allow two seconds of leeway (the time it takes for the API call to happen)
+	var kvItem KVItem
+	db.First(&kvItem)
+	if kvItem.TTL < int(time.Now().UnixMilli()+18000) || kvItem.TTL > int(time.Now().UnixMilli()+20000) {
+		t.Errorf("expected ttl to be about 20 seconds from now got %v (now: %v)", kvItem.TTL, time.Now().UnixMilli())
+	}
+}
+
+func TestSetKeyTTLAndTTLMs(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	// A ttl of -1 counts as passing ttl too
+	for _, body := range []string{
+		`{"key": "some_key", "value": "some_value", "ttl": 1986589728969, "ttlMs": 20000}`,
+		`{"key": "some_key", "value": "some_value", "ttl": -1, "ttlMs": 20000}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		setKey(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("expected 400 for %v got %v", body, res.StatusCode)
+		}
+	}
+}
+
+func TestExpireKey(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/expire", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "ttl": 1986589728969}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKeyTTL(db, false)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var kt KeyTTL
+	if err := json.NewDecoder(res.Body).Decode(&kt); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if kt.TTL != 1986589728969 || kt.RemainingMs <= 0 || kt.Version != 2 {
+		t.Errorf("expected ttl to be returned got %v", kt)
+	}
+
+	// Check the value was kept
+	var kvItem KVItem
+	db.First(&kvItem)
+	if kvItem.Value != "some_value" || kvItem.TTL != 1986589728969 || kvItem.Version != 2 {
+		t.Errorf("expected only the ttl to change got %v %v %v", kvItem.Value, kvItem.TTL, kvItem.Version)
+	}
+}
+
+func TestExpireKeyMissingTTL(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/expire", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKeyTTL(db, false)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("expected 400 got %v", res.StatusCode)
+	}
+}
+
+func TestPersistKey(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: 1986589728969, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/persist", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKeyTTL(db, true)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	var kvItem KVItem
+	db.First(&kvItem)
+	if kvItem.Value != "some_value" || kvItem.TTL != -1 {
+		t.Errorf("expected ttl to be cleared got %v %v", kvItem.Value, kvItem.TTL)
+	}
+}
+
+func TestPersistKeyExpired(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: 1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/persist", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKeyTTL(db, true)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
+
+func TestGetKeyTTL(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: int(time.Now().UnixMilli() + 20000), Version: 1, UserID: int(user.ID)})
+	db.Create(&KVItem{Key: "forever_key", Value: "some_value", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	getTTL := func(key string) KeyTTL {
+		req := httptest.NewRequest(http.MethodGet, "/kv/ttl", ioutil.NopCloser(strings.NewReader(`{"key": "`+key+`"}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		getKeyTTL(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var kt KeyTTL
+		if err := json.NewDecoder(res.Body).Decode(&kt); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		return kt
+	}
+
+	// Allow two seconds of leeway (the time it takes for the API call to happen)
+	if kt := getTTL("some_key"); kt.RemainingMs < 18000 || kt.RemainingMs > 20000 {
+		t.Errorf("expected about 20 seconds remaining got %v", kt.RemainingMs)
+	}
+	if kt := getTTL("forever_key"); kt.TTL != -1 || kt.RemainingMs != -1 {
+		t.Errorf("expected no expiry got %v %v", kt.TTL, kt.RemainingMs)
+	}
+}
+
+func TestGetKeyTTLBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/ttl", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	getKeyTTL(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
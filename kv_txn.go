@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+// TxnCompare is a condition on a key, exactly one of Value, Version and Exists must be set
+type TxnCompare struct {
+	Bucket  string  `json:"bucket"`
+	Key     string  `json:"key"`
+	Value   *string `json:"value"`
+	Version *int    `json:"version"`
+	Exists  *bool   `json:"exists"` // false means the key must be missing
+}
+
+// TxnOp is a single write, exactly one of Set and Delete must be set
+type TxnOp struct {
+	Set    *SetKeyRequest    `json:"set"`
+	Delete *DeleteKeyRequest `json:"delete"`
+}
+
+type TxnRequest struct {
+	Compare []TxnCompare `json:"compare"`
+	Ops     []TxnOp      `json:"ops"`
+}
+
+type TxnResult struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Version int    `json:"version"`
+	Deleted bool   `json:"deleted"`
+}
+
+type TxnResponse struct {
+	Results []TxnResult `json:"results"`
+}
+
+func checkTxnRequest(txn *TxnRequest) string {
+	if len(txn.Ops) == 0 {
+		return "expected at least one op"
+	} else if len(txn.Compare)+len(txn.Ops) > maxBatchSize {
+		return fmt.Sprintf("expected at most %v compares and ops", maxBatchSize)
+	}
+	for i, c := range txn.Compare {
+		conditions := 0
+		for _, set := range []bool{c.Value != nil, c.Version != nil, c.Exists != nil} {
+			if set {
+				conditions++
+			}
+		}
+		if c.Key == "" {
+			return fmt.Sprintf("compare %v: expected key to be non-empty", i)
+		} else if conditions != 1 {
+			return fmt.Sprintf("compare %v: expected exactly one of value, version and exists", i)
+		}
+	}
+	for i, op := range txn.Ops {
+		if (op.Set == nil) == (op.Delete == nil) {
+			return fmt.Sprintf("op %v: expected exactly one of set and delete", i)
+		} else if op.Set != nil {
+			if msg := prepareSetKeyRequest(op.Set); msg != "" {
+				return fmt.Sprintf("op %v: %v", i, msg)
+			} else if op.Set.Mode != "" {
+				return fmt.Sprintf("op %v: expected mode to be missing, use a compare instead", i)
+			}
+		} else if op.Delete.Key == "" {
+			return fmt.Sprintf("op %v: expected key to be non-empty", i)
+		}
+	}
+	return ""
+}
+
+// compareHolds checks a single condition against the current state of a key
+func compareHolds(tx *gorm.DB, userID uint, c *TxnCompare) (bool, error) {
+	var kvItem KVItem
+	err := liveKey(tx, userID, c.Bucket, c.Key).First(&kvItem).Error
+	exists := true
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		exists = false
+	} else if err != nil {
+		return false, err
+	}
+
+	if c.Exists != nil {
+		return exists == *c.Exists, nil
+	} else if c.Version != nil {
+		return exists && kvItem.Version == *c.Version, nil
+	}
+	return exists && kvItem.Value == *c.Value, nil
+}
+
+// txnKeys applies every op atomically, but only if every compare holds.
+// Deleting a key that doesn't exist is not an error
+func txnKeys(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("txnKeys", err, w)
+			return
+		}
+
+		var txn TxnRequest
+		err = json.NewDecoder(r.Body).Decode(&txn)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if msg := checkTxnRequest(&txn); msg != "" {
+			APIUserError(w, msg)
+			return
+		}
+
+		res := TxnResponse{Results: make([]TxnResult, len(txn.Ops))}
+		changes := make([]KeyChange, 0, len(txn.Ops))
+		written := make([]*KVItem, 0, len(txn.Ops))
+		err = retryKeyWrites(db, func(tx *gorm.DB) error {
+			changes, written = changes[:0], written[:0]
+			for i := range txn.Compare {
+				holds, err := compareHolds(tx, user.ID, &txn.Compare[i])
+				if err != nil {
+					return err
+				} else if !holds {
+					return newConflictError(fmt.Sprintf("compare %v on %v failed", i, txn.Compare[i].Key))
+				}
+			}
+
+			for i, op := range txn.Ops {
+				if op.Set != nil {
+					kvItem, err := writeKey(tx, user, op.Set)
+					if rErr, ok := err.(*requestError); ok {
+						rErr.message = fmt.Sprintf("op %v on %v: %v", i, op.Set.Key, rErr.message)
+						return rErr
+					} else if err != nil {
+						return err
+					}
+					res.Results[i] = TxnResult{Bucket: kvItem.Bucket, Key: kvItem.Key, Version: kvItem.Version}
+					changes = append(changes, KeyChange{KeyValue: newKeyValue(kvItem)})
+					written = append(written, kvItem)
+					continue
+				}
+
+				res.Results[i] = TxnResult{Bucket: op.Delete.Bucket, Key: op.Delete.Key, Deleted: true}
+				kvItem, err := removeKey(tx, user.ID, op.Delete.Bucket, op.Delete.Key, op.Delete.Trash)
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					continue
+				} else if err != nil {
+					return err
+				}
+				res.Results[i].Version = kvItem.Version
+				changes = append(changes, deletedKeyChange(kvItem))
+			}
+			return nil
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError("txnKeys", err, w)
+			return
+		}
+		kvWatchers.publish(user.ID, changes...)
+		kvExpiry.schedule(written...)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTxnKeys(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "a", Value: "1", TTL: -1, Version: 2, UserID: int(user.ID)})
+
+	body := `{
+		"compare": [{"key": "a", "version": 2}, {"key": "a", "value": "1"}, {"key": "b", "exists": false}],
+		"ops": [{"set": {"key": "b", "value": "1"}}, {"delete": {"key": "a"}}, {"delete": {"key": "c"}}]
+	}`
+	req := httptest.NewRequest(http.MethodGet, "/kv/txn", ioutil.NopCloser(strings.NewReader(body)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	txnKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var tr TxnResponse
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if len(tr.Results) != 3 {
+		t.Fatalf("expected three results got %v", tr.Results)
+	}
+	if tr.Results[0] != (TxnResult{Key: "b", Version: 1}) || tr.Results[1] != (TxnResult{Key: "a", Version: 2, Deleted: true}) || tr.Results[2] != (TxnResult{Key: "c", Deleted: true}) {
+		t.Errorf("expected results for b, a, c got %v", tr.Results)
+	}
+
+	// Check the value moved from a to b
+	var kvItems []KVItem
+	db.Find(&kvItems)
+	if len(kvItems) != 1 || kvItems[0].Key != "b" || kvItems[0].Value != "1" {
+		t.Errorf("expected only b to exist got %v", kvItems)
+	}
+}
+
+func TestTxnKeysCompareFails(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "a", Value: "1", TTL: -1, Version: 2, UserID: int(user.ID)})
+
+	for _, compare := range []string{
+		`{"key": "a", "version": 1}`,
+		`{"key": "a", "value": "2"}`,
+		`{"key": "a", "exists": false}`,
+		`{"key": "b", "exists": true}`,
+		`{"key": "b", "value": ""}`,
+	} {
+		body := `{"compare": [` + compare + `], "ops": [{"set": {"key": "b", "value": "1"}}, {"delete": {"key": "a"}}]}`
+		req := httptest.NewRequest(http.MethodGet, "/kv/txn", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		txnKeys(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 409 {
+			t.Errorf("expected 409 for %v got %v", compare, res.StatusCode)
+		}
+	}
+
+	// Check nothing was written
+	var kvItems []KVItem
+	db.Find(&kvItems)
+	if len(kvItems) != 1 || kvItems[0].Key != "a" || kvItems[0].Version != 2 {
+		t.Errorf("expected only a to exist got %v", kvItems)
+	}
+}
+
+func TestTxnKeysOpConflictRollsBack(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "a", Value: "1", TTL: -1, Version: 2, UserID: int(user.ID)})
+
+	body := `{"ops": [{"delete": {"key": "a"}}, {"set": {"key": "b", "value": "1", "ifVersion": 5}}]}`
+	req := httptest.NewRequest(http.MethodGet, "/kv/txn", ioutil.NopCloser(strings.NewReader(body)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	txnKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+
+	var count int64
+	db.Model(&KVItem{}).Where("key = ?", "a").Count(&count)
+	if count != 1 {
+		t.Errorf("expected the delete to be rolled back")
+	}
+}
+
+func TestTxnKeysBadRequest(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for _, body := range []string{
+		`{"ops": []}`,
+		`{"compare": [{"key": "a", "version": 1, "exists": true}], "ops": [{"delete": {"key": "a"}}]}`,
+		`{"ops": [{"set": {"key": "a", "value": "1"}, "delete": {"key": "a"}}]}`,
+		`{"ops": [{"set": {"key": "", "value": "1"}}]}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/txn", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		txnKeys(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("expected 400 for %v got %v", body, res.StatusCode)
+		}
+	}
+}
+
+func TestTxnKeysBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/txn", ioutil.NopCloser(strings.NewReader(`{"ops": [{"delete": {"key": "a"}}]}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	txnKeys(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
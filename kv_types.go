@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Key types other than plain strings. The KVItem holds the key's TTL and version
+// while the data itself lives in a table for the type, keyed by the KVItem's ID
+const (
+	typeString = ""
+	typeHash   = "hash"
+	typeZSet   = "zset"
+	typeList   = "list"
+)
+
+func wrongTypeError(kvItem *KVItem) *requestError {
+	typ := kvItem.Type
+	if typ == typeString {
+		typ = "string"
+	}
+	return newConflictError(fmt.Sprintf("key holds a %v", typ))
+}
+
+// deleteTypedData removes the data stored for keys that aren't plain strings.
+// ids is either a list of KVItem IDs or a subquery that selects them
+func deleteTypedData(tx *gorm.DB, ids interface{}) error {
+	for _, model := range []interface{}{&KVHashField{}, &KVZSetMember{}, &KVListElement{}} {
+		if err := tx.Unscoped().Where("kv_item_id IN (?)", ids).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteKeyData removes everything stored alongside keys, including their tags,
+// for when keys are removed or replaced. ids is the same as for deleteTypedData
+func deleteKeyData(tx *gorm.DB, ids interface{}) error {
+	if err := deleteTypedData(tx, ids); err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("kv_item_id IN (?)", ids).Delete(&KVTag{}).Error
+}
+
+// liveTypedKey loads a live key for reading, returning gorm.ErrRecordNotFound if it's missing
+// or a *requestError if the key holds another type
+func liveTypedKey(tx *gorm.DB, userID uint, bucket string, key string, typ string) (*KVItem, error) {
+	var kvItem KVItem
+	if err := liveKey(tx, userID, bucket, key).First(&kvItem).Error; err != nil {
+		return nil, err
+	} else if kvItem.Type != typ {
+		return nil, wrongTypeError(&kvItem)
+	}
+	return &kvItem, nil
+}
+
+// typedKey loads a live key of the given type inside a transaction, returning a *requestError
+// if the key holds another type. With create, a missing or expired key is created empty,
+// otherwise gorm.ErrRecordNotFound is returned. Call touchKey after changing the key's data
+func typedKey(tx *gorm.DB, user *User, bucket string, key string, typ string, create bool) (*KVItem, error) {
+	// Nothing can be added to a typed key under a prefix with a schema, including one that was
+	// created before the schema, though its data can still be removed
+	if create {
+		if err := checkKeySchemaType(tx, user.ID, bucket, key); err != nil {
+			return nil, err
+		}
+	}
+	var ki KVItem
+	err := userKey(tx, user.ID, bucket, key).First(&ki).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	found := err == nil
+	if found && (ki.TTL == -1 || ki.TTL >= int(time.Now().UnixMilli())) {
+		if ki.Type != typ {
+			return nil, wrongTypeError(&ki)
+		}
+		return &ki, nil
+	} else if !create {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	b, err := getBucket(tx, user.ID, bucket)
+	if err != nil {
+		return nil, err
+	}
+	ttl := -1
+	if b.DefaultTTLMs > 0 {
+		ttl = int(time.Now().UnixMilli()) + b.DefaultTTLMs
+	}
+	if !found {
+		last, err := lastKeyVersion(tx, user.ID, bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		// The last version is never seen outside the transaction as touchKey bumps it
+		ki = KVItem{UserID: int(user.ID), Bucket: bucket, Key: key, Type: typ, TTL: ttl, Version: last, created: true}
+		written, err := upsertKey(tx, &ki, false)
+		if err != nil {
+			return nil, err
+		} else if !written && ki.Type != typ {
+			// The key was created by a concurrent writer, ki now holds it
+			return nil, wrongTypeError(&ki)
+		}
+		return &ki, nil
+	}
+
+	// An expired key that hasn't been cleared up yet is replaced
+	if err = deleteKeyData(tx, []uint{ki.ID}); err != nil {
+		return nil, err
+	} else if err = keyEvent(tx, eventOpExpire, &ki, ki.Version); err != nil {
+		return nil, err
+	} else if err = deleteKeyHistory(tx, user.ID, bucket, key); err != nil {
+		return nil, err
+	}
+	ki.Type, ki.Value, ki.ContentType, ki.TTL = typ, "", "", ttl
+	return &ki, tx.Model(&ki).Select("type", "value", "content_type", "ttl").Updates(&ki).Error
+}
+
+// touchOrRemoveKey is touchKey for when data has been removed from a key,
+// the key is deleted instead if it has no data left. model is the type's table
+func touchOrRemoveKey(tx *gorm.DB, ki *KVItem, model interface{}) (bool, error) {
+	var remaining int64
+	if err := tx.Model(model).Where("kv_item_id = ?", ki.ID).Count(&remaining).Error; err != nil {
+		return false, err
+	} else if remaining == 0 {
+		// An empty key isn't worth keeping in the trash
+		_, err = removeKey(tx, uint(ki.UserID), ki.Bucket, ki.Key, false)
+		return true, err
+	}
+	return false, touchKey(tx, ki)
+}
+
+// rankRange turns an inclusive range of ranks, where negative ranks count back from
+// the end, into offsets that are within a collection of size total. The range is empty if start > stop
+func rankRange(start int, stop int, total int) (int, int) {
+	if start < 0 {
+		start += total
+	}
+	if stop < 0 {
+		stop += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= total {
+		stop = total - 1
+	}
+	return start, stop
+}
+
+// touchKey bumps the version of a key whose data has changed
+func touchKey(tx *gorm.DB, ki *KVItem) error {
+	result := tx.Model(&KVItem{}).Where("id = ? AND version = ?", ki.ID, ki.Version).Update("version", ki.Version+1)
+	if result.Error != nil {
+		return result.Error
+	} else if result.RowsAffected == 0 {
+		return newConflictError("key was modified concurrently")
+	}
+	ki.Version++
+	oldVersion := ki.Version - 1
+	if ki.created {
+		oldVersion = 0
+	}
+	return keyEvent(tx, eventOpSet, ki, oldVersion)
+}
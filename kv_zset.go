@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+type ZSetMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+type ZSetAddRequest struct {
+	Bucket  string       `json:"bucket"`
+	Key     string       `json:"key"`
+	Members []ZSetMember `json:"members"`
+}
+
+type ZSetAddResponse struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Added   int    `json:"added"` // how many of the members didn't exist before
+	Version int    `json:"version"`
+}
+
+type ZSetRemoveRequest struct {
+	Bucket  string   `json:"bucket"`
+	Key     string   `json:"key"`
+	Members []string `json:"members"`
+}
+
+type ZSetRemoveResponse struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Key     string `json:"key"`
+	Removed int    `json:"removed"`
+	Version int    `json:"version"`
+	Deleted bool   `json:"deleted"` // the last member was removed so the key was deleted too
+}
+
+// ZSetRangeRequest selects members by rank, negative ranks count back from the last member
+type ZSetRangeRequest struct {
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	Start   int    `json:"start"`
+	Stop    int    `json:"stop"` // inclusive
+	Reverse bool   `json:"reverse"`
+}
+
+// ZSetRangeByScoreRequest selects members with min <= score <= max, a missing min or max is unbounded
+type ZSetRangeByScoreRequest struct {
+	Bucket  string   `json:"bucket"`
+	Key     string   `json:"key"`
+	Min     *float64 `json:"min"`
+	Max     *float64 `json:"max"`
+	Reverse bool     `json:"reverse"`
+	Offset  int      `json:"offset"`
+	Limit   int      `json:"limit"`
+}
+
+type ZSetRangeResponse struct {
+	Bucket  string       `json:"bucket,omitempty"`
+	Key     string       `json:"key"`
+	Members []ZSetMember `json:"members"`
+	Version int          `json:"version"`
+}
+
+type ZSetRankRequest struct {
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	Member  string `json:"member"`
+	Reverse bool   `json:"reverse"`
+}
+
+type ZSetRankResponse struct {
+	Bucket  string  `json:"bucket,omitempty"`
+	Key     string  `json:"key"`
+	Member  string  `json:"member"`
+	Score   float64 `json:"score"`
+	Rank    int     `json:"rank"` // starts at 0
+	Version int     `json:"version"`
+}
+
+func zsetOrder(reverse bool) string {
+	if reverse {
+		return "score DESC, member DESC"
+	}
+	return "score, member"
+}
+
+func zsetMembers(rows []KVZSetMember) []ZSetMember {
+	members := make([]ZSetMember, 0, len(rows))
+	for _, row := range rows {
+		members = append(members, ZSetMember{Member: row.Member, Score: row.Score})
+	}
+	return members
+}
+
+// zsetAdd adds members to a sorted set or updates their scores.
+// A missing key is created with the bucket's default TTL
+func zsetAdd(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("zsetAdd", err, w)
+			return
+		}
+
+		var za ZSetAddRequest
+		err = json.NewDecoder(r.Body).Decode(&za)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if za.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+		if len(za.Members) == 0 || len(za.Members) > maxBatchSize {
+			APIUserError(w, fmt.Sprintf("expected between 1 and %v members", maxBatchSize))
+			return
+		}
+		for _, m := range za.Members {
+			if m.Member == "" {
+				APIUserError(w, "expected members to be non-empty")
+				return
+			}
+		}
+
+		res := ZSetAddResponse{Bucket: za.Bucket, Key: za.Key}
+		var kvItem *KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			bucket, err := getBucket(tx, user.ID, za.Bucket)
+			if err != nil {
+				return err
+			}
+			for _, m := range za.Members {
+				if bucket.MaxValueSize > 0 && len(m.Member) > bucket.MaxValueSize {
+					return newTooLargeError(fmt.Sprintf("expected members to be at most %v bytes", bucket.MaxValueSize))
+				}
+			}
+
+			if kvItem, err = typedKey(tx, user, za.Bucket, za.Key, typeZSet, true); err != nil {
+				return err
+			}
+			// A member that's passed more than once ends up with its last score
+			for _, m := range za.Members {
+				var zm KVZSetMember
+				err = tx.Where("kv_item_id = ? AND member = ?", kvItem.ID, m.Member).First(&zm).Error
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					if err = tx.Create(&KVZSetMember{KVItemID: kvItem.ID, Member: m.Member, Score: m.Score}).Error; err != nil {
+						return err
+					}
+					res.Added++
+				} else if err != nil {
+					return err
+				} else if err = tx.Model(&zm).Update("score", m.Score).Error; err != nil {
+					return err
+				}
+			}
+			return touchKey(tx, kvItem)
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError("zsetAdd", err, w)
+			return
+		}
+		kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(kvItem)})
+		kvExpiry.schedule(kvItem)
+		res.Version = kvItem.Version
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// zsetRemove removes members from a sorted set, the key is deleted along with its last member
+func zsetRemove(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("zsetRemove", err, w)
+			return
+		}
+
+		var zr ZSetRemoveRequest
+		err = json.NewDecoder(r.Body).Decode(&zr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if zr.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+		if len(zr.Members) == 0 || len(zr.Members) > maxBatchSize {
+			APIUserError(w, fmt.Sprintf("expected between 1 and %v members", maxBatchSize))
+			return
+		}
+
+		res := ZSetRemoveResponse{Bucket: zr.Bucket, Key: zr.Key}
+		var kvItem *KVItem
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if kvItem, err = typedKey(tx, user, zr.Bucket, zr.Key, typeZSet, false); err != nil {
+				return err
+			}
+			result := tx.Unscoped().Where("kv_item_id = ? AND member IN ?", kvItem.ID, zr.Members).Delete(&KVZSetMember{})
+			if result.Error != nil {
+				return result.Error
+			} else if result.RowsAffected == 0 {
+				return nil
+			}
+			res.Removed = int(result.RowsAffected)
+			res.Deleted, err = touchOrRemoveKey(tx, kvItem, &KVZSetMember{})
+			return err
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("zsetRemove", err, w)
+			return
+		}
+		if res.Deleted {
+			kvWatchers.publish(user.ID, deletedKeyChange(kvItem))
+		} else if res.Removed > 0 {
+			kvWatchers.publish(user.ID, KeyChange{KeyValue: newKeyValue(kvItem)})
+		}
+		res.Version = kvItem.Version
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// zsetRange returns the members between two ranks, like Redis' ZRANGE
+func zsetRange(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("zsetRange", err, w)
+			return
+		}
+
+		zr := &ZSetRangeRequest{Start: 0, Stop: -1}
+		err = json.NewDecoder(r.Body).Decode(&zr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if zr.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+
+		var rows []KVZSetMember
+		kvItem, err := liveTypedKey(db, user.ID, zr.Bucket, zr.Key, typeZSet)
+		if err == nil {
+			var total int64
+			if err = db.Model(&KVZSetMember{}).Where("kv_item_id = ?", kvItem.ID).Count(&total).Error; err != nil {
+				APIServerError("zsetRange", err, w)
+				return
+			}
+			start, stop := rankRange(zr.Start, zr.Stop, int(total))
+			if stop-start+1 > maxListLimit {
+				APIUserError(w, fmt.Sprintf("expected at most %v members in the range", maxListLimit))
+				return
+			} else if start <= stop {
+				err = db.Where("kv_item_id = ?", kvItem.ID).Order(zsetOrder(zr.Reverse)).
+					Offset(start).Limit(stop - start + 1).Find(&rows).Error
+			}
+		}
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("zsetRange", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&ZSetRangeResponse{Bucket: kvItem.Bucket, Key: kvItem.Key, Members: zsetMembers(rows), Version: kvItem.Version})
+	}
+}
+
+// zsetRangeByScore returns a page of the members whose scores are between min and max
+func zsetRangeByScore(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("zsetRangeByScore", err, w)
+			return
+		}
+
+		zr := &ZSetRangeByScoreRequest{Limit: defaultListLimit}
+		err = json.NewDecoder(r.Body).Decode(&zr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if zr.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+		if zr.Limit < 1 || zr.Limit > maxListLimit {
+			APIUserError(w, fmt.Sprintf("expected limit to be between 1 and %v", maxListLimit))
+			return
+		}
+		if zr.Offset < 0 {
+			APIUserError(w, "expected offset not to be negative")
+			return
+		}
+
+		var rows []KVZSetMember
+		kvItem, err := liveTypedKey(db, user.ID, zr.Bucket, zr.Key, typeZSet)
+		if err == nil {
+			query := db.Where("kv_item_id = ?", kvItem.ID)
+			if zr.Min != nil {
+				query = query.Where("score >= ?", *zr.Min)
+			}
+			if zr.Max != nil {
+				query = query.Where("score <= ?", *zr.Max)
+			}
+			err = query.Order(zsetOrder(zr.Reverse)).Offset(zr.Offset).Limit(zr.Limit).Find(&rows).Error
+		}
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("zsetRangeByScore", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&ZSetRangeResponse{Bucket: kvItem.Bucket, Key: kvItem.Key, Members: zsetMembers(rows), Version: kvItem.Version})
+	}
+}
+
+// zsetRank returns a member's score and its rank, which is 0 for the lowest score
+// (or the highest with reverse)
+func zsetRank(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("zsetRank", err, w)
+			return
+		}
+
+		var zr ZSetRankRequest
+		err = json.NewDecoder(r.Body).Decode(&zr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if zr.Key == "" || zr.Member == "" {
+			APIUserError(w, "expected key and member to be non-empty")
+			return
+		}
+
+		var zm KVZSetMember
+		var rank int64
+		kvItem, err := liveTypedKey(db, user.ID, zr.Bucket, zr.Key, typeZSet)
+		if err == nil {
+			err = db.Where("kv_item_id = ? AND member = ?", kvItem.ID, zr.Member).First(&zm).Error
+		}
+		if err == nil {
+			// Count the members that sort before this one
+			before := "score < ? OR (score = ? AND member < ?)"
+			if zr.Reverse {
+				before = "score > ? OR (score = ? AND member > ?)"
+			}
+			err = db.Model(&KVZSetMember{}).Where("kv_item_id = ?", kvItem.ID).
+				Where(before, zm.Score, zm.Score, zm.Member).Count(&rank).Error
+		}
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("zsetRank", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&ZSetRankResponse{Bucket: kvItem.Bucket, Key: kvItem.Key, Member: zm.Member, Score: zm.Score, Rank: int(rank), Version: kvItem.Version})
+	}
+}
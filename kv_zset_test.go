@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// createZSet stores a sorted set directly, members are given in any order
+func createZSet(db *gorm.DB, user *User, key string, members ...ZSetMember) *KVItem {
+	kvItem := &KVItem{Key: key, Type: typeZSet, TTL: -1, Version: 1, UserID: int(user.ID)}
+	db.Create(kvItem)
+	for _, m := range members {
+		db.Create(&KVZSetMember{KVItemID: kvItem.ID, Member: m.Member, Score: m.Score})
+	}
+	return kvItem
+}
+
+func TestZSetAdd(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for i, body := range []string{
+		`{"key": "some_zset", "members": [{"member": "a", "score": 1}, {"member": "b", "score": 2}]}`,
+		`{"key": "some_zset", "members": [{"member": "b", "score": 3}, {"member": "c", "score": 0.5}]}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/zadd", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		zsetAdd(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var za ZSetAddResponse
+		if err := json.NewDecoder(res.Body).Decode(&za); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if za.Added != 2-i || za.Version != i+1 {
+			t.Errorf("expected %v added at version %v got %v", 2-i, i+1, za)
+		}
+	}
+
+	var members []KVZSetMember
+	db.Order("score").Find(&members)
+	if len(members) != 3 || members[0].Member != "c" || members[1].Member != "a" || members[2].Member != "b" || members[2].Score != 3 {
+		t.Errorf("expected members c, a, b got %v", members)
+	}
+}
+
+func TestZSetAddWrongType(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "1", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/zadd", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "members": [{"member": "a", "score": 1}]}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	zsetAdd(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+}
+
+func TestZSetAddBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/zadd", ioutil.NopCloser(strings.NewReader(`{"key": "some_zset", "members": [{"member": "a", "score": 1}]}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	zsetAdd(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestZSetRemove(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	createZSet(db, user, "some_zset", ZSetMember{"a", 1}, ZSetMember{"b", 2})
+
+	for i, expected := range []ZSetRemoveResponse{
+		{Key: "some_zset", Removed: 1, Version: 2},
+		{Key: "some_zset", Removed: 1, Version: 2, Deleted: true},
+	} {
+		body := `{"key": "some_zset", "members": ["a", "c"]}`
+		if i == 1 {
+			body = `{"key": "some_zset", "members": ["b"]}`
+		}
+		req := httptest.NewRequest(http.MethodGet, "/kv/zrem", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		zsetRemove(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var zr ZSetRemoveResponse
+		if err := json.NewDecoder(res.Body).Decode(&zr); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if zr != expected {
+			t.Errorf("expected %v got %v", expected, zr)
+		}
+	}
+
+	var count int64
+	db.Unscoped().Model(&KVItem{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected key to be removed got %v", count)
+	}
+}
+
+func TestZSetRange(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	createZSet(db, user, "some_zset", ZSetMember{"d", 4}, ZSetMember{"a", 1}, ZSetMember{"c", 2}, ZSetMember{"b", 2})
+
+	for body, expected := range map[string][]ZSetMember{
+		`{"key": "some_zset"}`:                               {{"a", 1}, {"b", 2}, {"c", 2}, {"d", 4}},
+		`{"key": "some_zset", "start": 1, "stop": 2}`:        {{"b", 2}, {"c", 2}},
+		`{"key": "some_zset", "start": -2, "stop": -1}`:      {{"c", 2}, {"d", 4}},
+		`{"key": "some_zset", "stop": 1, "reverse": true}`:   {{"d", 4}, {"c", 2}},
+		`{"key": "some_zset", "start": 3, "stop": 10}`:       {{"d", 4}},
+		`{"key": "some_zset", "start": 5, "stop": 10}`:       {},
+		`{"key": "some_zset", "start": -10, "stop": 0}`:      {{"a", 1}},
+		`{"key": "some_zset", "start": 2, "stop": 1}`:        {},
+		`{"key": "some_zset", "start": 0, "stop": -4}`:       {{"a", 1}},
+		`{"key": "some_zset", "start": -1, "reverse": true}`: {{"a", 1}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/zrange", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		zsetRange(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 for %v got %v", body, res.StatusCode)
+		}
+		var zr ZSetRangeResponse
+		if err := json.NewDecoder(res.Body).Decode(&zr); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if !reflect.DeepEqual(zr.Members, expected) {
+			t.Errorf("expected %v for %v got %v", expected, body, zr.Members)
+		}
+	}
+}
+
+func TestZSetRangeMissing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/zrange", ioutil.NopCloser(strings.NewReader(`{"key": "some_zset"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	zsetRange(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
+
+func TestZSetRangeByScore(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	createZSet(db, user, "some_zset", ZSetMember{"d", 4}, ZSetMember{"a", 1}, ZSetMember{"c", 2}, ZSetMember{"b", 2})
+
+	for body, expected := range map[string][]ZSetMember{
+		`{"key": "some_zset"}`:                                      {{"a", 1}, {"b", 2}, {"c", 2}, {"d", 4}},
+		`{"key": "some_zset", "min": 2}`:                            {{"b", 2}, {"c", 2}, {"d", 4}},
+		`{"key": "some_zset", "max": 2}`:                            {{"a", 1}, {"b", 2}, {"c", 2}},
+		`{"key": "some_zset", "min": 1.5, "max": 3, "offset": 1}`:   {{"c", 2}},
+		`{"key": "some_zset", "reverse": true, "limit": 2}`:         {{"d", 4}, {"c", 2}},
+		`{"key": "some_zset", "min": 5}`:                            {},
+		`{"key": "some_zset", "min": 1, "max": 2, "reverse": true}`: {{"c", 2}, {"b", 2}, {"a", 1}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/zrangebyscore", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		zsetRangeByScore(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 for %v got %v", body, res.StatusCode)
+		}
+		var zr ZSetRangeResponse
+		if err := json.NewDecoder(res.Body).Decode(&zr); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if !reflect.DeepEqual(zr.Members, expected) {
+			t.Errorf("expected %v for %v got %v", expected, body, zr.Members)
+		}
+	}
+}
+
+func TestZSetRank(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	createZSet(db, user, "some_zset", ZSetMember{"d", 4}, ZSetMember{"a", 1}, ZSetMember{"c", 2}, ZSetMember{"b", 2})
+
+	for body, expected := range map[string]int{
+		`{"key": "some_zset", "member": "a"}`:                  0,
+		`{"key": "some_zset", "member": "c"}`:                  2,
+		`{"key": "some_zset", "member": "d"}`:                  3,
+		`{"key": "some_zset", "member": "d", "reverse": true}`: 0,
+		`{"key": "some_zset", "member": "b", "reverse": true}`: 2,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/zrank", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		zsetRank(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 for %v got %v", body, res.StatusCode)
+		}
+		var zr ZSetRankResponse
+		if err := json.NewDecoder(res.Body).Decode(&zr); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if zr.Rank != expected {
+			t.Errorf("expected rank %v for %v got %v", expected, body, zr.Rank)
+		}
+	}
+}
+
+func TestZSetRankMissing(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	createZSet(db, user, "some_zset", ZSetMember{"a", 1})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/zrank", ioutil.NopCloser(strings.NewReader(`{"key": "some_zset", "member": "b"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	zsetRank(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404 got %v", res.StatusCode)
+	}
+}
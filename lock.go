@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type LockRequest struct {
+	Name    string `json:"name"`
+	Owner   string `json:"owner"`
+	Token   int    `json:"token"`   // the fencing token from acquire, for renew and release
+	LeaseMs int    `json:"leaseMs"` // for acquire and renew
+}
+
+type LockResponse struct {
+	Name      string `json:"name"`
+	Owner     string `json:"owner"`
+	Token     int    `json:"token"`
+	ExpiresAt int    `json:"expiresAt"` // UnixMilli
+}
+
+func newLockResponse(lock *Lock) LockResponse {
+	return LockResponse{Name: lock.Name, Owner: lock.Owner, Token: lock.Token, ExpiresAt: lock.ExpiresAt}
+}
+
+func (lock *Lock) held() bool {
+	return lock.Owner != "" && lock.ExpiresAt >= int(time.Now().UnixMilli())
+}
+
+// updateLock saves a change to a lock, matching on the token so
+// a concurrent acquire can't be overwritten
+func updateLock(tx *gorm.DB, lock *Lock, token int) error {
+	result := tx.Model(&Lock{}).Where("id = ? AND token = ?", lock.ID, token).
+		Updates(map[string]interface{}{"owner": lock.Owner, "expires_at": lock.ExpiresAt, "token": lock.Token})
+	if result.Error != nil {
+		return result.Error
+	} else if result.RowsAffected == 0 {
+		return newConflictError("lock was acquired concurrently")
+	}
+	return nil
+}
+
+// checkLockRequest returns a message describing what's wrong with lr, or "" if it's valid
+func checkLockRequest(lr *LockRequest, needsToken bool, needsLease bool) string {
+	if lr.Name == "" || lr.Owner == "" {
+		return "expected name and owner to be non-empty"
+	} else if needsToken && lr.Token < 1 {
+		return "expected token to be positive"
+	} else if needsLease && lr.LeaseMs < 1 {
+		return "expected leaseMs to be positive"
+	}
+	return ""
+}
+
+// acquireLock takes a lock that's free, expired, or already held by the same owner.
+// Every successful acquire returns a new fencing token that's higher than any before it
+func acquireLock(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("acquireLock", err, w)
+			return
+		}
+
+		var lr LockRequest
+		err = json.NewDecoder(r.Body).Decode(&lr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if msg := checkLockRequest(&lr, false, true); msg != "" {
+			APIUserError(w, msg)
+			return
+		}
+
+		var lock Lock
+		err = db.Transaction(func(tx *gorm.DB) error {
+			expiresAt := int(time.Now().UnixMilli()) + lr.LeaseMs
+			err := tx.Where("user_id = ? AND name = ?", user.ID, lr.Name).First(&lock).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				lock = Lock{UserID: int(user.ID), Name: lr.Name, Owner: lr.Owner, ExpiresAt: expiresAt, Token: 1}
+				result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&lock)
+				if result.Error != nil || result.RowsAffected == 1 {
+					return result.Error
+				}
+				// Another acquire created the lock first, so it's acquired like an existing lock
+				lock = Lock{}
+				if err = tx.Where("user_id = ? AND name = ?", user.ID, lr.Name).First(&lock).Error; err != nil {
+					return err
+				}
+			} else if err != nil {
+				return err
+			}
+
+			if lock.held() && lock.Owner != lr.Owner {
+				return newConflictError("lock is held by another owner")
+			}
+			token := lock.Token
+			lock.Owner, lock.ExpiresAt, lock.Token = lr.Owner, expiresAt, lock.Token+1
+			return updateLock(tx, &lock, token)
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if err != nil {
+			APIServerError("acquireLock", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		res := newLockResponse(&lock)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// renewLock extends the lease of a lock that's still held with the given token
+func renewLock(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("renewLock", err, w)
+			return
+		}
+
+		var lr LockRequest
+		err = json.NewDecoder(r.Body).Decode(&lr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if msg := checkLockRequest(&lr, true, true); msg != "" {
+			APIUserError(w, msg)
+			return
+		}
+
+		var lock Lock
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("user_id = ? AND name = ?", user.ID, lr.Name).First(&lock).Error; err != nil {
+				return err
+			}
+			// Once a lease has expired the holder has to acquire the lock again
+			if !lock.held() || lock.Owner != lr.Owner || lock.Token != lr.Token {
+				return newConflictError("lock is not held with this owner and token")
+			}
+			lock.ExpiresAt = int(time.Now().UnixMilli()) + lr.LeaseMs
+			return updateLock(tx, &lock, lock.Token)
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("renewLock", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		res := newLockResponse(&lock)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// releaseLock frees a lock so it can be acquired straight away.
+// Releasing a lock whose lease has expired is fine as long as no one else has acquired it since
+func releaseLock(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("releaseLock", err, w)
+			return
+		}
+
+		var lr LockRequest
+		err = json.NewDecoder(r.Body).Decode(&lr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if msg := checkLockRequest(&lr, true, false); msg != "" {
+			APIUserError(w, msg)
+			return
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			var lock Lock
+			if err := tx.Where("user_id = ? AND name = ?", user.ID, lr.Name).First(&lock).Error; err != nil {
+				return err
+			}
+			if lock.Owner != lr.Owner || lock.Token != lr.Token {
+				return newConflictError("lock is not held with this owner and token")
+			}
+			lock.Owner, lock.ExpiresAt = "", 0
+			return updateLock(tx, &lock, lock.Token)
+		})
+		if rErr, ok := err.(*requestError); ok {
+			apiRequestError(w, rErr)
+			return
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			APIServerError("releaseLock", err, w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestAcquireLock(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	// The same owner can acquire again and gets a new token
+	for _, expected := range []int{1, 2} {
+		req := httptest.NewRequest(http.MethodGet, "/lock/acquire", ioutil.NopCloser(strings.NewReader(`{"name": "some_lock", "owner": "a", "leaseMs": 20000}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		acquireLock(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var lr LockResponse
+		if err := json.NewDecoder(res.Body).Decode(&lr); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if lr.Name != "some_lock" || lr.Owner != "a" || lr.Token != expected {
+			t.Errorf("expected token %v got %v", expected, lr)
+		}
+		if lr.ExpiresAt < int(time.Now().UnixMilli()+18000) || lr.ExpiresAt > int(time.Now().UnixMilli()+20000) {
+			t.Errorf("expected lease to be 20000ms got %v", lr.ExpiresAt)
+		}
+	}
+}
+
+func TestAcquireLockHeld(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&Lock{Name: "some_lock", Owner: "a", ExpiresAt: int(time.Now().UnixMilli() + 20000), Token: 3, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/lock/acquire", ioutil.NopCloser(strings.NewReader(`{"name": "some_lock", "owner": "b", "leaseMs": 20000}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	acquireLock(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+}
+
+// createLockConcurrently creates lock just before the next lock is created, as if by another
+// acquire that read the lock as missing at the same time
+func createLockConcurrently(db *gorm.DB, lock *Lock) {
+	created := false
+	db.Callback().Create().Before("gorm:create").Register("test:create_lock_concurrently", func(tx *gorm.DB) {
+		if l, ok := tx.Statement.Dest.(*Lock); ok && l != lock && !created {
+			created = true
+			tx.Session(&gorm.Session{NewDB: true}).Create(lock)
+		}
+	})
+}
+
+func TestAcquireLockCreatedConcurrently(t *testing.T) {
+	// A lock that's still held can't be taken, one whose lease has expired can
+	for _, tc := range []struct {
+		expiresAt int
+		expected  int
+	}{
+		{int(time.Now().UnixMilli() + 20000), 409},
+		{1, 200},
+	} {
+		db := getDB(GetDBOptions{testing: true})
+		user := &User{Token: "a"}
+		db.Create(user)
+		createLockConcurrently(db, &Lock{Name: "some_lock", Owner: "a", ExpiresAt: tc.expiresAt, Token: 1, UserID: int(user.ID)})
+
+		req := httptest.NewRequest(http.MethodGet, "/lock/acquire", ioutil.NopCloser(strings.NewReader(`{"name": "some_lock", "owner": "b", "leaseMs": 20000}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		acquireLock(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != tc.expected {
+			t.Errorf("expected %v got %v", tc.expected, res.StatusCode)
+		}
+
+		var lock Lock
+		db.First(&lock)
+		if tc.expected == 200 && (lock.Owner != "b" || lock.Token != 2) {
+			t.Errorf("expected b to take over the lock with token 2 got %v %v", lock.Owner, lock.Token)
+		}
+	}
+}
+
+func TestAcquireLockExpired(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&Lock{Name: "some_lock", Owner: "a", ExpiresAt: 1, Token: 3, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/lock/acquire", ioutil.NopCloser(strings.NewReader(`{"name": "some_lock", "owner": "b", "leaseMs": 20000}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	acquireLock(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var lr LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lr); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if lr.Owner != "b" || lr.Token != 4 {
+		t.Errorf("expected b to hold the lock with token 4 got %v", lr)
+	}
+}
+
+func TestAcquireLockBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/lock/acquire", ioutil.NopCloser(strings.NewReader(`{"name": "some_lock", "owner": "a", "leaseMs": 20000}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	acquireLock(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
+
+func TestRenewLock(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&Lock{Name: "some_lock", Owner: "a", ExpiresAt: int(time.Now().UnixMilli() + 1000), Token: 3, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/lock/renew", ioutil.NopCloser(strings.NewReader(`{"name": "some_lock", "owner": "a", "token": 3, "leaseMs": 20000}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	renewLock(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var lr LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lr); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if lr.Token != 3 || lr.ExpiresAt < int(time.Now().UnixMilli()+18000) {
+		t.Errorf("expected lease to be extended with the same token got %v", lr)
+	}
+}
+
+func TestRenewLockNotHeld(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&Lock{Name: "some_lock", Owner: "a", ExpiresAt: int(time.Now().UnixMilli() + 20000), Token: 3, UserID: int(user.ID)})
+	db.Create(&Lock{Name: "expired_lock", Owner: "a", ExpiresAt: 1, Token: 3, UserID: int(user.ID)})
+
+	for _, body := range []string{
+		`{"name": "some_lock", "owner": "b", "token": 3, "leaseMs": 20000}`,
+		`{"name": "some_lock", "owner": "a", "token": 2, "leaseMs": 20000}`,
+		`{"name": "expired_lock", "owner": "a", "token": 3, "leaseMs": 20000}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/lock/renew", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		renewLock(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 409 {
+			t.Errorf("expected 409 for %v got %v", body, res.StatusCode)
+		}
+	}
+}
+
+func TestReleaseLock(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&Lock{Name: "some_lock", Owner: "a", ExpiresAt: int(time.Now().UnixMilli() + 20000), Token: 3, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/lock/release", ioutil.NopCloser(strings.NewReader(`{"name": "some_lock", "owner": "a", "token": 3}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	releaseLock(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+
+	// Check another owner can acquire it straight away and the token keeps going up
+	req = httptest.NewRequest(http.MethodGet, "/lock/acquire", ioutil.NopCloser(strings.NewReader(`{"name": "some_lock", "owner": "b", "leaseMs": 20000}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w = httptest.NewRecorder()
+	acquireLock(db)(w, req)
+
+	res = w.Result()
+	defer res.Body.Close()
+	var lr LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lr); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if lr.Owner != "b" || lr.Token != 4 {
+		t.Errorf("expected b to hold the lock with token 4 got %v", lr)
+	}
+}
+
+func TestReleaseLockWrongToken(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&Lock{Name: "some_lock", Owner: "a", ExpiresAt: int(time.Now().UnixMilli() + 20000), Token: 3, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/lock/release", ioutil.NopCloser(strings.NewReader(`{"name": "some_lock", "owner": "a", "token": 2}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	releaseLock(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Errorf("expected 409 got %v", res.StatusCode)
+	}
+
+	var lock Lock
+	db.First(&lock)
+	if lock.Owner != "a" {
+		t.Errorf("expected lock to still be held got %v", lock.Owner)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RateLimitRequest struct {
+	Key             string  `json:"key"`
+	Capacity        int     `json:"capacity"`        // the most tokens the bucket can hold
+	RefillPerSecond float64 `json:"refillPerSecond"` // tokens added back every second
+	Cost            int     `json:"cost"`            // tokens taken by this call, defaults to 1
+}
+
+type RateLimitResponse struct {
+	Key          string  `json:"key"`
+	Allowed      bool    `json:"allowed"`
+	Remaining    float64 `json:"remaining"`
+	RetryAfterMs int     `json:"retryAfterMs"` // how long until the call would be allowed, 0 when it was
+}
+
+// maxRateLimitAttempts bounds how many times a check is retried when it overlaps with another
+const maxRateLimitAttempts = 10
+
+var errRateLimitContended = errors.New("rate limit was checked concurrently")
+
+// refill tops up a bucket for the time that's passed since it was last checked
+func (rl *RateLimit) refill(rr *RateLimitRequest, now int) {
+	if elapsed := now - rl.RefilledAt; elapsed > 0 {
+		rl.Tokens += float64(elapsed) * rr.RefillPerSecond / 1000
+	}
+	// The capacity may have been lowered since the last check
+	rl.Tokens = math.Min(rl.Tokens, float64(rr.Capacity))
+	rl.RefilledAt = now
+}
+
+// checkRateLimit takes cost tokens from a token bucket if it has enough, otherwise nothing
+// is taken and the call is denied. A key's bucket starts full, and the capacity and refill
+// rate are passed on every call so they can be changed at any time
+func checkRateLimit(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("checkRateLimit", err, w)
+			return
+		}
+
+		rr := &RateLimitRequest{Cost: 1}
+		err = json.NewDecoder(r.Body).Decode(&rr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if rr.Key == "" {
+			APIUserError(w, "expected key to be non-empty")
+			return
+		}
+		if rr.Capacity < 1 || rr.RefillPerSecond <= 0 {
+			APIUserError(w, "expected capacity and refillPerSecond to be positive")
+			return
+		}
+		if rr.Cost < 1 || rr.Cost > rr.Capacity {
+			APIUserError(w, "expected cost to be between 1 and capacity")
+			return
+		}
+
+		// Overlapping checks on the same key are retried so that contention doesn't change the answer
+		var res RateLimitResponse
+		for attempt := 1; ; attempt++ {
+			res, err = takeTokens(db, user, rr)
+			if !errors.Is(err, errRateLimitContended) || attempt == maxRateLimitAttempts {
+				break
+			}
+		}
+		if errors.Is(err, errRateLimitContended) {
+			apiErrorMessage(w, http.StatusConflict, "rate limit was checked concurrently")
+			return
+		} else if err != nil {
+			APIServerError("checkRateLimit", err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// takeTokens does one read-refill-update of a key's bucket, returning errRateLimitContended
+// if another check changed the bucket first
+func takeTokens(db *gorm.DB, user *User, rr *RateLimitRequest) (RateLimitResponse, error) {
+	res := RateLimitResponse{Key: rr.Key}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := int(time.Now().UnixMilli())
+		var rl RateLimit
+		err := tx.Where("user_id = ? AND key = ?", user.ID, rr.Key).First(&rl).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			rl = RateLimit{UserID: int(user.ID), Key: rr.Key, Tokens: float64(rr.Capacity), RefilledAt: now}
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rl)
+			if result.Error != nil {
+				return result.Error
+			} else if result.RowsAffected == 0 {
+				return errRateLimitContended
+			}
+		} else if err != nil {
+			return err
+		}
+
+		tokens, refilledAt := rl.Tokens, rl.RefilledAt
+		rl.refill(rr, now)
+		if rl.Tokens >= float64(rr.Cost) {
+			rl.Tokens -= float64(rr.Cost)
+			res.Allowed = true
+		} else {
+			res.RetryAfterMs = int(math.Ceil((float64(rr.Cost) - rl.Tokens) / rr.RefillPerSecond * 1000))
+		}
+		res.Remaining = rl.Tokens
+
+		// Matching on the previous state means two calls can't spend the same tokens
+		result := tx.Model(&RateLimit{}).Where("id = ? AND tokens = ? AND refilled_at = ?", rl.ID, tokens, refilledAt).
+			Updates(map[string]interface{}{"tokens": rl.Tokens, "refilled_at": rl.RefilledAt})
+		if result.Error != nil {
+			return result.Error
+		} else if result.RowsAffected == 0 {
+			return errRateLimitContended
+		}
+		return nil
+	})
+	return res, err
+}
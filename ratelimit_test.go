@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestCheckRateLimit(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	// A slow refill so the bucket doesn't noticeably refill during the test
+	for i, expected := range []RateLimitResponse{
+		{Key: "some_key", Allowed: true, Remaining: 1},
+		{Key: "some_key", Allowed: true, Remaining: 0},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/ratelimit/check", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "capacity": 3, "refillPerSecond": 0.001, "cost": `+[]string{"2", "1"}[i]+`}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		checkRateLimit(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var rl RateLimitResponse
+		if err := json.NewDecoder(res.Body).Decode(&rl); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if rl.Key != expected.Key || rl.Allowed != expected.Allowed || rl.Remaining < expected.Remaining || rl.Remaining > expected.Remaining+0.01 {
+			t.Errorf("expected %v got %v", expected, rl)
+		}
+	}
+
+	// Check the next call is denied without taking tokens
+	req := httptest.NewRequest(http.MethodGet, "/ratelimit/check", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "capacity": 3, "refillPerSecond": 0.001}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	checkRateLimit(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	var rl RateLimitResponse
+	if err := json.NewDecoder(res.Body).Decode(&rl); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if rl.Allowed || rl.RetryAfterMs < 990000 || rl.RetryAfterMs > 1000000 {
+		t.Errorf("expected to be denied for about 1000s got %v", rl)
+	}
+}
+
+func TestCheckRateLimitContended(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&RateLimit{Key: "some_key", Tokens: 2, RefilledAt: int(time.Now().UnixMilli()), UserID: int(user.ID)})
+
+	// The first attempt's update finds the bucket changed as if by another check, and is rolled back
+	contended := false
+	db.Callback().Update().Before("gorm:update").Register("test:contend", func(tx *gorm.DB) {
+		if _, ok := tx.Statement.Model.(*RateLimit); ok && !contended {
+			contended = true
+			tx.Session(&gorm.Session{NewDB: true}).Exec("UPDATE rate_limits SET tokens = tokens - 1")
+		}
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/ratelimit/check", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "capacity": 2, "refillPerSecond": 0.001}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	checkRateLimit(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var rl RateLimitResponse
+	if err := json.NewDecoder(res.Body).Decode(&rl); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if !contended || !rl.Allowed || rl.Remaining < 1 || rl.Remaining > 1.01 {
+		t.Errorf("expected the retry to be allowed got %v", rl)
+	}
+}
+
+func TestCheckRateLimitRefill(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&RateLimit{Key: "some_key", Tokens: 0, RefilledAt: int(time.Now().UnixMilli() - 1500), UserID: int(user.ID)})
+	db.Create(&RateLimit{Key: "full_key", Tokens: 0, RefilledAt: int(time.Now().UnixMilli() - 60000), UserID: int(user.ID)})
+
+	// 1.5s at 2 tokens a second is 3 tokens, and a long wait is capped at the capacity
+	for key, expected := range map[string]float64{"some_key": 2, "full_key": 4} {
+		req := httptest.NewRequest(http.MethodGet, "/ratelimit/check", ioutil.NopCloser(strings.NewReader(`{"key": "`+key+`", "capacity": 5, "refillPerSecond": 2}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		checkRateLimit(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected 200 got %v", res.StatusCode)
+		}
+		var rl RateLimitResponse
+		if err := json.NewDecoder(res.Body).Decode(&rl); err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if !rl.Allowed || rl.Remaining < expected || rl.Remaining > expected+0.1 {
+			t.Errorf("expected %v to be allowed with %v remaining got %v", key, expected, rl)
+		}
+	}
+}
+
+func TestCheckRateLimitBadRequest(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for _, body := range []string{
+		`{"key": "", "capacity": 5, "refillPerSecond": 1}`,
+		`{"key": "some_key", "capacity": 0, "refillPerSecond": 1}`,
+		`{"key": "some_key", "capacity": 5, "refillPerSecond": 0}`,
+		`{"key": "some_key", "capacity": 5, "refillPerSecond": 1, "cost": 6}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/ratelimit/check", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		checkRateLimit(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("expected 400 for %v got %v", body, res.StatusCode)
+		}
+	}
+}
+
+func TestCheckRateLimitBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/ratelimit/check", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "capacity": 5, "refillPerSecond": 1}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	checkRateLimit(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
@@ -1,19 +1,95 @@
 package main
 
 import (
+	"context"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	db := getDB(GetDBOptions{local: true})
 
 	http.HandleFunc("/user/new", createUser(db))
+	http.HandleFunc("/user/settings", userSettings(db))
+	http.HandleFunc("/bucket/create", createBucket(db))
+	http.HandleFunc("/bucket/list", listBuckets(db))
+	http.HandleFunc("/bucket/delete", deleteBucket(db))
 	http.HandleFunc("/kv/set", setKey(db))
 	http.HandleFunc("/kv/get", getKey(db))
+	http.HandleFunc("/kv/raw/", rawKey(db))
+	http.HandleFunc("/kv/history", keyHistory(db))
+	http.HandleFunc("/kv/patch", patchKey(db))
+	http.HandleFunc("/kv/delete", deleteKey(db))
+	http.HandleFunc("/kv/query", queryKeys(db))
+	http.HandleFunc("/kv/trash/list", listTrash(db))
+	http.HandleFunc("/kv/trash/restore", restoreTrash(db))
+	http.HandleFunc("/kv/list", listKeys(db))
+	http.HandleFunc("/kv/mget", multiGetKeys(db))
+	http.HandleFunc("/kv/mset", multiSetKeys(db))
+	http.HandleFunc("/kv/txn", txnKeys(db))
+	http.HandleFunc("/kv/expire", setKeyTTL(db, false))
+	http.HandleFunc("/kv/persist", setKeyTTL(db, true))
+	http.HandleFunc("/kv/ttl", getKeyTTL(db))
+	http.HandleFunc("/kv/watch", watchKey(db))
+	http.HandleFunc("/kv/incr", incrKey(db, 1))
+	http.HandleFunc("/kv/decr", incrKey(db, -1))
+	http.HandleFunc("/kv/hset", hashSet(db))
+	http.HandleFunc("/kv/hget", hashGet(db))
+	http.HandleFunc("/kv/hgetall", hashGetAll(db))
+	http.HandleFunc("/kv/hdel", hashDelete(db))
+	http.HandleFunc("/kv/hincr", hashIncr(db))
+	http.HandleFunc("/kv/zadd", zsetAdd(db))
+	http.HandleFunc("/kv/zrem", zsetRemove(db))
+	http.HandleFunc("/kv/zrange", zsetRange(db))
+	http.HandleFunc("/kv/zrangebyscore", zsetRangeByScore(db))
+	http.HandleFunc("/kv/zrank", zsetRank(db))
+	http.HandleFunc("/kv/lpush", listPush(db, true))
+	http.HandleFunc("/kv/rpush", listPush(db, false))
+	http.HandleFunc("/kv/lpop", listPop(db, true))
+	http.HandleFunc("/kv/rpop", listPop(db, false))
+	http.HandleFunc("/kv/lrange", listRange(db))
+	http.HandleFunc("/kv/llen", listLen(db))
+	http.HandleFunc("/kv/ltrim", listTrim(db))
+	http.HandleFunc("/lock/acquire", acquireLock(db))
+	http.HandleFunc("/lock/renew", renewLock(db))
+	http.HandleFunc("/lock/release", releaseLock(db))
+	http.HandleFunc("/ratelimit/check", checkRateLimit(db))
+	http.HandleFunc("/event/create", createEventRule(db))
+	http.HandleFunc("/event/list", listEventRules(db))
+	http.HandleFunc("/event/delete", deleteEventRule(db))
+	http.HandleFunc("/schema/set", setKeySchema(db))
+	http.HandleFunc("/schema/list", listKeySchemas(db))
+	http.HandleFunc("/schema/delete", deleteKeySchema(db))
 	http.HandleFunc("/queue/send", sendMessage(db))
 	http.HandleFunc("/queue/receive", receiveMessage(db))
 	http.HandleFunc("/queue/delete", deleteMessage(db))
 
-	KVCron(db)
-	http.ListenAndServe(":8000", nil)
+	if err := kvExpiry.start(db); err != nil {
+		log.Fatalf("error starting expiry scheduler: %v", err)
+	}
+	purger := newTrashPurger()
+	purger.start(db)
+
+	server := &http.Server{Addr: ":8000"}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("error serving: %v", err)
+		}
+	}()
+
+	// Finish in-flight requests and the current expiry and purge batches before exiting
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down: %v", err)
+	}
+	kvExpiry.stop()
+	purger.stop()
 }
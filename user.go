@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"gorm.io/gorm"
@@ -30,3 +31,55 @@ func createUser(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
 		json.NewEncoder(w).Encode(tokRes)
 	}
 }
+
+type UserSettings struct {
+	HistoryLimit     *int `json:"historyLimit"`
+	TrashRetentionMs *int `json:"trashRetentionMs"`
+}
+
+// userSettings updates any settings that are passed and returns all of them
+func userSettings(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("userSettings", err, w)
+			return
+		}
+
+		var us UserSettings
+		err = json.NewDecoder(r.Body).Decode(&us)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+
+		updates := map[string]interface{}{}
+		if us.HistoryLimit != nil {
+			if *us.HistoryLimit < 0 || *us.HistoryLimit > maxHistoryLimit {
+				APIUserError(w, fmt.Sprintf("expected historyLimit to be between 0 and %v", maxHistoryLimit))
+				return
+			}
+			updates["history_limit"] = *us.HistoryLimit
+		}
+		if us.TrashRetentionMs != nil {
+			if *us.TrashRetentionMs < 0 || *us.TrashRetentionMs > maxTrashRetentionMs {
+				APIUserError(w, fmt.Sprintf("expected trashRetentionMs to be between 0 and %v", maxTrashRetentionMs))
+				return
+			}
+			updates["trash_retention_ms"] = *us.TrashRetentionMs
+		}
+		if len(updates) > 0 {
+			if err = db.Model(user).Updates(updates).Error; err != nil {
+				APIServerError("userSettings", err, w)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&UserSettings{HistoryLimit: &user.HistoryLimit, TrashRetentionMs: &user.TrashRetentionMs})
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -44,3 +46,117 @@ func TestCreateUser(t *testing.T) {
 		t.Errorf("expected user token not to be empty")
 	}
 }
+
+func TestUserSettings(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/user/settings", ioutil.NopCloser(strings.NewReader(`{"historyLimit": 3}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	userSettings(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var us UserSettings
+	if err := json.NewDecoder(res.Body).Decode(&us); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if us.HistoryLimit == nil || *us.HistoryLimit != 3 {
+		t.Errorf("expected historyLimit to be returned got %v", us.HistoryLimit)
+	}
+
+	// Check the setting was saved
+	db.First(user)
+	if user.HistoryLimit != 3 {
+		t.Errorf("expected historyLimit to be 3 got %v", user.HistoryLimit)
+	}
+}
+
+func TestUserSettingsTrashRetention(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	for body, expected := range map[string]int{
+		`{"trashRetentionMs": 60000}`:      200,
+		`{"trashRetentionMs": -1}`:         400,
+		`{"trashRetentionMs": 7776000001}`: 400,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/user/settings", ioutil.NopCloser(strings.NewReader(body)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		userSettings(db)(w, req)
+
+		res := w.Result()
+		defer res.Body.Close()
+		if res.StatusCode != expected {
+			t.Errorf("expected %v for %v got %v", expected, body, res.StatusCode)
+		}
+	}
+
+	// Check only the valid setting was saved
+	db.First(user)
+	if user.TrashRetentionMs != 60000 {
+		t.Errorf("expected trashRetentionMs to be 60000 got %v", user.TrashRetentionMs)
+	}
+}
+
+func TestUserSettingsDefaults(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/user/settings", ioutil.NopCloser(strings.NewReader(`{}`)))
+	req.Header.Set("Authorization", "Bearer a")
+	w := httptest.NewRecorder()
+	userSettings(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	var us UserSettings
+	if err := json.NewDecoder(res.Body).Decode(&us); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if us.HistoryLimit == nil || *us.HistoryLimit != 10 {
+		t.Errorf("expected default historyLimit of 10 got %v", us.HistoryLimit)
+	}
+	if us.TrashRetentionMs == nil || *us.TrashRetentionMs != 604800000 {
+		t.Errorf("expected default trashRetentionMs of 7 days got %v", us.TrashRetentionMs)
+	}
+}
+
+func TestUserSettingsBadHistoryLimit(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/user/settings", ioutil.NopCloser(strings.NewReader(`{"historyLimit": -1}`)))
+	req.Header.Set("Authorization", "Bearer a")
+	w := httptest.NewRecorder()
+	userSettings(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("expected 400 got %v", res.StatusCode)
+	}
+}
+
+func TestUserSettingsBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/user/settings", ioutil.NopCloser(strings.NewReader(`{}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	userSettings(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}
@@ -27,17 +27,59 @@ func APIServerError(route string, err error, w http.ResponseWriter) {
 }
 
 type UserError struct {
-	Message string `json:"message"`
+	Message    string   `json:"message"`
+	Violations []string `json:"violations,omitempty"`
 }
 
 func APIUserError(w http.ResponseWriter, message string) {
-	w.WriteHeader(http.StatusBadRequest)
+	apiErrorMessage(w, http.StatusBadRequest, message)
+}
+
+func apiErrorMessage(w http.ResponseWriter, status int, message string) {
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(&UserError{
 		Message: message,
 	})
 }
 
+func apiRequestError(w http.ResponseWriter, rErr *requestError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(rErr.status)
+	json.NewEncoder(w).Encode(&UserError{
+		Message:    rErr.message,
+		Violations: rErr.violations,
+	})
+}
+
+// requestError is for requests that were well-formed but can't be applied,
+// e.g. a version check didn't hold (409) or a bucket doesn't exist (404)
+type requestError struct {
+	status     int
+	message    string
+	violations []string // why a value didn't match its schema (422)
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func newConflictError(message string) *requestError {
+	return &requestError{status: http.StatusConflict, message: message}
+}
+
+func newNotFoundError(message string) *requestError {
+	return &requestError{status: http.StatusNotFound, message: message}
+}
+
+func newTooLargeError(message string) *requestError {
+	return &requestError{status: http.StatusRequestEntityTooLarge, message: message}
+}
+
+func newUnprocessableError(message string) *requestError {
+	return &requestError{status: http.StatusUnprocessableEntity, message: message}
+}
+
 type authError struct{}
 
 func (e *authError) Error() string {
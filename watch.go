@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// KeyChange is the new state of a key. For deletions only Bucket, Key
+// and Version (the last version the key had) are set
+type KeyChange struct {
+	KeyValue
+	Deleted bool `json:"deleted"`
+}
+
+func deletedKeyChange(kvItem *KVItem) KeyChange {
+	return KeyChange{KeyValue: KeyValue{Bucket: kvItem.Bucket, Key: kvItem.Key, Version: kvItem.Version}, Deleted: true}
+}
+
+type watcher struct {
+	userID uint
+	bucket string
+	key    string
+	prefix bool
+	ch     chan KeyChange
+}
+
+func (wr *watcher) matches(userID uint, bucket string, key string) bool {
+	if wr.userID != userID || wr.bucket != bucket {
+		return false
+	} else if wr.prefix {
+		return strings.HasPrefix(key, wr.key)
+	}
+	return wr.key == key
+}
+
+// watchHub passes key changes to any requests that are long-polling /kv/watch.
+// It only knows about this process so changes must be published after they're committed
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]struct{})}
+}
+
+var kvWatchers = newWatchHub()
+
+func (h *watchHub) subscribe(userID uint, bucket string, key string, prefix bool) *watcher {
+	wr := &watcher{userID: userID, bucket: bucket, key: key, prefix: prefix, ch: make(chan KeyChange, 1)}
+	h.mu.Lock()
+	h.watchers[wr] = struct{}{}
+	h.mu.Unlock()
+	return wr
+}
+
+func (h *watchHub) unsubscribe(wr *watcher) {
+	h.mu.Lock()
+	delete(h.watchers, wr)
+	h.mu.Unlock()
+}
+
+func (h *watchHub) publish(userID uint, changes ...KeyChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, change := range changes {
+		for wr := range h.watchers {
+			if !wr.matches(userID, change.Bucket, change.Key) {
+				continue
+			}
+			// Watchers only need the first change, so don't block on the rest
+			select {
+			case wr.ch <- change:
+			default:
+			}
+		}
+	}
+}
+
+type WatchRequest struct {
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	Prefix  string `json:"prefix"`
+	Version int    `json:"version"`
+	Timeout int    `json:"timeout"` // milliseconds
+}
+
+const defaultWatchTimeout = 30000
+const maxWatchTimeout = 60000
+
+func watchKey(db *gorm.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := auth(db, r)
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			APIServerError("watchKey", err, w)
+			return
+		}
+
+		wr := &WatchRequest{Timeout: defaultWatchTimeout}
+		err = json.NewDecoder(r.Body).Decode(&wr)
+		if err != nil {
+			APIUserError(w, "error parsing JSON")
+			return
+		}
+		if (wr.Key == "") == (wr.Prefix == "") {
+			APIUserError(w, "expected exactly one of key and prefix to be non-empty")
+			return
+		}
+		if wr.Timeout < 1 || wr.Timeout > maxWatchTimeout {
+			APIUserError(w, fmt.Sprintf("expected timeout to be between 1 and %v", maxWatchTimeout))
+			return
+		}
+
+		// Subscribe before looking at the current state so nothing is missed in between
+		var sub *watcher
+		if wr.Key != "" {
+			sub = kvWatchers.subscribe(user.ID, wr.Bucket, wr.Key, false)
+		} else {
+			sub = kvWatchers.subscribe(user.ID, wr.Bucket, wr.Prefix, true)
+		}
+		defer kvWatchers.unsubscribe(sub)
+
+		// A single key may have already moved past the caller's version
+		if wr.Key != "" {
+			var kvItem KVItem
+			err = liveKey(db, user.ID, wr.Bucket, wr.Key).First(&kvItem).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				if wr.Version > 0 {
+					writeKeyChange(w, deletedKeyChange(&KVItem{Bucket: wr.Bucket, Key: wr.Key, Version: wr.Version}))
+					return
+				}
+			} else if err != nil {
+				APIServerError("watchKey", err, w)
+				return
+			} else if kvItem.Version != wr.Version {
+				writeKeyChange(w, KeyChange{KeyValue: newKeyValue(&kvItem)})
+				return
+			}
+		}
+
+		timer := time.NewTimer(time.Duration(wr.Timeout) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case change := <-sub.ch:
+			writeKeyChange(w, change)
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+		case <-r.Context().Done():
+		}
+	}
+}
+
+func writeKeyChange(w http.ResponseWriter, change KeyChange) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&change)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchKeyAlreadyChanged(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 2, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/watch", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "version": 1}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	watchKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var change KeyChange
+	if err := json.NewDecoder(res.Body).Decode(&change); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if change.Key != "some_key" || change.Value != "some_value" || change.Version != 2 || change.Deleted {
+		t.Errorf("expected current value got %v", change)
+	}
+}
+
+func TestWatchKeyAlreadyDeleted(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/watch", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "version": 4}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	watchKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	var change KeyChange
+	if err := json.NewDecoder(res.Body).Decode(&change); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if change.Key != "some_key" || !change.Deleted {
+		t.Errorf("expected deletion marker got %v", change)
+	}
+}
+
+func TestWatchPrefixWaitsForChange(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	done := make(chan *http.Response)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/kv/watch", ioutil.NopCloser(strings.NewReader(`{"prefix": "app:", "timeout": 5000}`)))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		w := httptest.NewRecorder()
+		watchKey(db)(w, req)
+		done <- w.Result()
+	}()
+
+	// Wait for the watch to subscribe
+	for {
+		kvWatchers.mu.Lock()
+		subscribed := len(kvWatchers.watchers) > 0
+		kvWatchers.mu.Unlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	kvWatchers.publish(user.ID+1, KeyChange{KeyValue: KeyValue{Key: "app:a", Value: "other user", Version: 1}})
+	kvWatchers.publish(user.ID, KeyChange{KeyValue: KeyValue{Key: "other:a", Value: "other prefix", Version: 1}})
+	kvWatchers.publish(user.ID, KeyChange{KeyValue: KeyValue{Key: "app:a", Version: 3}, Deleted: true})
+
+	res := <-done
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected 200 got %v", res.StatusCode)
+	}
+	var change KeyChange
+	if err := json.NewDecoder(res.Body).Decode(&change); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if change.Key != "app:a" || change.Version != 3 || !change.Deleted {
+		t.Errorf("expected deletion of app:a got %v", change)
+	}
+}
+
+func TestWatchKeyTimeout(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+	db.Create(&KVItem{Key: "some_key", Value: "some_value", TTL: -1, Version: 1, UserID: int(user.ID)})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/watch", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "version": 1, "timeout": 10}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	watchKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 204 {
+		t.Errorf("expected 204 got %v", res.StatusCode)
+	}
+}
+
+func TestSetKeyPublishesChange(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	sub := kvWatchers.subscribe(user.ID, "", "some_key", false)
+	defer kvWatchers.unsubscribe(sub)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/set", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "value": "some_value"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	setKey(db)(w, req)
+
+	select {
+	case change := <-sub.ch:
+		if change.Key != "some_key" || change.Value != "some_value" || change.TTL != -1 || change.Version != 1 {
+			t.Errorf("expected change to be published got %v", change)
+		}
+	default:
+		t.Errorf("expected a change to be published")
+	}
+}
+
+func TestWatchKeyBadRequest(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	user := &User{Token: "a"}
+	db.Create(user)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/watch", ioutil.NopCloser(strings.NewReader(`{"key": "some_key", "prefix": "some_"}`)))
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	w := httptest.NewRecorder()
+	watchKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("expected 400 got %v", res.StatusCode)
+	}
+}
+
+func TestWatchKeyBadAuth(t *testing.T) {
+	db := getDB(GetDBOptions{testing: true})
+	db.Create(&User{Token: "a"})
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/watch", ioutil.NopCloser(strings.NewReader(`{"key": "some_key"}`)))
+	req.Header.Set("Authorization", "Bearer b")
+	w := httptest.NewRecorder()
+	watchKey(db)(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 got %v", res.StatusCode)
+	}
+}